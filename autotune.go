@@ -0,0 +1,56 @@
+package connmux
+
+import (
+	"time"
+)
+
+var (
+	rttSampleInterval = 1 * time.Second
+)
+
+// autoTuning makes receive windows adapt to how quickly the application
+// consumes data. Similar to HTTP/2's BDP estimation, each stream measures how
+// much data the application consumes per round trip (the bandwidth-delay
+// product) and sizes its window at twice that, so that the sender can keep the
+// pipe full without us buffering more than necessary. Round trip times are
+// measured by the session using ping frames.
+//
+// Windows only grow or shrink within minWindow and maxWindow. Until a round
+// trip time has been measured, streams keep using their static window.
+type autoTuning struct {
+	minWindow int
+	maxWindow int
+	rtt       func() time.Duration
+}
+
+func newAutoTuning(minWindowSize int, maxWindowSize int, rtt func() time.Duration) *autoTuning {
+	minWindow := byteWindow(minWindowSize)
+	maxWindow := byteWindow(maxWindowSize)
+	if maxWindow < minWindow {
+		maxWindow = minWindow
+	}
+	return &autoTuning{
+		minWindow: minWindow,
+		maxWindow: maxWindow,
+		rtt:       rtt,
+	}
+}
+
+// targetWindow calculates the window needed to keep up with an application
+// that consumed the given number of bytes over elapsed. If there isn't enough
+// information yet, this returns 0.
+func (t *autoTuning) targetWindow(consumed int, elapsed time.Duration) int {
+	rtt := t.rtt()
+	if rtt <= 0 || elapsed < rtt {
+		// Need to observe at least one full round trip
+		return 0
+	}
+	bdp := int(int64(consumed) * int64(rtt) / int64(elapsed))
+	target := 2 * bdp
+	if target < t.minWindow {
+		target = t.minWindow
+	} else if target > t.maxWindow {
+		target = t.maxWindow
+	}
+	return target
+}
@@ -0,0 +1,50 @@
+package connmux
+
+import (
+	"io"
+	"net"
+)
+
+// Client starts a multiplexed Session as the client on a net.Conn that has
+// already been established, for example after a TLS handshake or over a
+// WebSocket. The other end of conn needs to use Server. Streams are opened
+// with Session.OpenStream and, unlike with a Dialer, the Session isn't replaced
+// if it fails. cfg may be nil, in which case defaults are used.
+//
+// If the session can't be started, conn is left open for the caller to deal
+// with.
+func Client(conn net.Conn, cfg *Config) (Session, error) {
+	cfg = cfg.withDefaults()
+	version, err := clientHandshake(conn, cfg.WindowSize, cfg.MinProtocolVersion, cfg.MaxProtocolVersion)
+	if err != nil {
+		return nil, err
+	}
+	return startSession(conn, true, version, cfg.WindowSize, cfg, nil, nil), nil
+}
+
+// Server starts a multiplexed Session as the server on a net.Conn that has
+// already been established, with the other end using Client (or a Dialer).
+// Streams opened by the client are received with Session.AcceptStream. If the
+// other end doesn't start a session, this returns ErrNotASession. cfg may be
+// nil, in which case defaults are used. Since clients tell the server what
+// window size to use, cfg.WindowSize is ignored.
+//
+// If the session can't be started, conn is left open for the caller to deal
+// with.
+func Server(conn net.Conn, cfg *Config) (Session, error) {
+	cfg = cfg.withDefaults()
+	b := make([]byte, sessionStartTotalLen)
+	_, err := io.ReadFull(conn, b)
+	if err != nil {
+		return nil, err
+	}
+	if string(b[:sessionStartHeaderLen]) != sessionStart {
+		return nil, ErrNotASession
+	}
+	version, err := negotiateVersion(conn, b[sessionStartHeaderLen], cfg.MinProtocolVersion, cfg.MaxProtocolVersion)
+	if err != nil {
+		return nil, err
+	}
+	windowSize := int(b[sessionStartTotalLen-1])
+	return startSession(conn, false, version, windowSize, cfg, nil, nil), nil
+}
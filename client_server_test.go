@@ -0,0 +1,73 @@
+package connmux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientServer(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	serverCh := make(chan Session, 1)
+	go func() {
+		server, err := Server(serverConn, &Config{Pool: NewBufferPool(100)})
+		if assert.NoError(t, err) {
+			serverCh <- server
+		}
+	}()
+	client, err := Client(clientConn, &Config{Pool: NewBufferPool(100)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	server := <-serverCh
+	defer server.Close()
+
+	roundTrip := func(opener Session, accepter Session) {
+		opened, openErr := opener.OpenStream()
+		if !assert.NoError(t, openErr) {
+			return
+		}
+		assert.True(t, opener.NumStreams() > 0)
+		accepted, acceptErr := accepter.AcceptStream()
+		if !assert.NoError(t, acceptErr) {
+			return
+		}
+		go echo(t, accepted, nil)
+		_, writeErr := opened.Write([]byte(testdata))
+		if !assert.NoError(t, writeErr) {
+			return
+		}
+		b := make([]byte, len(testdata))
+		_, readErr := io.ReadFull(opened, b)
+		if assert.NoError(t, readErr) {
+			assert.Equal(t, testdata, string(b))
+		}
+		assert.NoError(t, opened.(Stream).CloseWrite())
+	}
+	assert.Equal(t, 0, client.NumStreams())
+	roundTrip(client, server)
+	roundTrip(server, client)
+
+	client.Close()
+	select {
+	case <-server.CloseChan():
+		// okay
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Server should have closed once client closed")
+	}
+	_, err = server.AcceptStream()
+	assert.Equal(t, ErrConnectionClosed, err)
+}
+
+func TestServerNotASession(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go clientConn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, err := Server(serverConn, nil)
+	assert.Equal(t, ErrNotASession, err)
+}
@@ -0,0 +1,92 @@
+package connmux
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	// maxCloseReasonLen is the longest reason that fits in an RST frame.
+	// Longer reasons are truncated.
+	maxCloseReasonLen = 255
+)
+
+// CloseCode tells the other end of a Stream why it was closed. With protocol
+// version 5 and above, it's carried in the RST frame that closes the stream,
+// along with an optional short reason (see Stream.CloseWithError). Codes other
+// than the ones defined here can be used to convey application-specific
+// reasons.
+//
+// When the Session itself dies, no RST is sent. Instead, the streams on both
+// ends fail with the error that closed the Session.
+type CloseCode uint32
+
+const (
+	// CloseNormal means that the stream was closed normally with Close(). The
+	// other end's reads return io.EOF once it has read everything that was
+	// sent, just as they do with peers that don't send close codes.
+	CloseNormal CloseCode = 0
+
+	// CloseCanceled means that the end that opened the stream gave up on it,
+	// for example because the context passed to DialContext was done before
+	// the stream was accepted.
+	CloseCanceled CloseCode = 1
+
+	// CloseTimeout means that data written to the stream couldn't be sent
+	// within Config.CloseTimeout of closing it, so some of it was lost.
+	CloseTimeout CloseCode = 2
+
+	// CloseRefused means that the application refused to handle the stream
+	// after it was accepted.
+	CloseRefused CloseCode = 3
+
+	// CloseInternalError means that the application ran into an error while
+	// handling the stream.
+	CloseInternalError CloseCode = 4
+)
+
+func (code CloseCode) String() string {
+	switch code {
+	case CloseNormal:
+		return "normal"
+	case CloseCanceled:
+		return "canceled"
+	case CloseTimeout:
+		return "timeout"
+	case CloseRefused:
+		return "refused"
+	case CloseInternalError:
+		return "internal error"
+	default:
+		return fmt.Sprintf("code %d", uint32(code))
+	}
+}
+
+// truncateCloseReason truncates reason to maxCloseReasonLen bytes without
+// splitting a UTF-8 encoded character.
+func truncateCloseReason(reason string) string {
+	if len(reason) <= maxCloseReasonLen {
+		return reason
+	}
+	i := maxCloseReasonLen
+	for i > 0 && !utf8.RuneStart(reason[i]) {
+		i--
+	}
+	return reason[:i]
+}
+
+// StreamClosedError is returned from reading and writing a Stream that the
+// other end closed with a CloseCode other than CloseNormal. It's also the
+// reason reported to Hooks.OnStreamClose when either end closes a stream with
+// such a code.
+type StreamClosedError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (e *StreamClosedError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("stream closed: %v", e.Code)
+	}
+	return fmt.Sprintf("stream closed: %v: %v", e.Code, e.Reason)
+}
@@ -0,0 +1,23 @@
+package connmux
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateCloseReason(t *testing.T) {
+	assert.Equal(t, "short", truncateCloseReason("short"))
+
+	exact := strings.Repeat("a", maxCloseReasonLen)
+	assert.Equal(t, exact, truncateCloseReason(exact))
+	assert.Equal(t, exact, truncateCloseReason(exact+"b"))
+
+	// "é" takes 2 bytes, so the last one would straddle the limit
+	accented := strings.Repeat("é", maxCloseReasonLen)
+	truncated := truncateCloseReason(accented)
+	assert.Len(t, truncated, maxCloseReasonLen-1)
+	assert.True(t, utf8.ValidString(truncated), "Truncating shouldn't split characters")
+}
@@ -0,0 +1,179 @@
+package connmux
+
+import (
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+const (
+	// DefaultWindowSize is the window size used if none is configured
+	DefaultWindowSize = 25
+
+	// DefaultCloseTimeout is the close timeout used if none is configured
+	DefaultCloseTimeout = 30 * time.Second
+
+	// DefaultBufferPoolSize is the size of the BufferPool that's used if none is
+	// configured
+	DefaultBufferPoolSize = 1000
+
+	// DefaultAcceptBacklog is the accept backlog used if none is configured
+	DefaultAcceptBacklog = 256
+
+	// DefaultStreamPriority is the stream priority used if none is configured
+	DefaultStreamPriority = 16
+
+	// the window size is sent as a single byte during session start
+	maxWindowSize = 255
+)
+
+// Config configures multiplexing for dialers (see StreamDialerWithConfig) and
+// listeners (see WrapListenerWithConfig). Fields that are left at their zero
+// value use sensible defaults, so an empty Config is valid.
+type Config struct {
+	// WindowSize is how many frames to queue per stream, used to bound memory
+	// use. Each frame takes about 8KB of memory. 25 is a good default, 50 yields
+	// higher throughput, more than 50 hasn't been seen to have much of an
+	// effect. Must be no more than 255. The dialer tells the listener about its
+	// window size and both ends use that, so listeners ignore this. Defaults to
+	// DefaultWindowSize.
+	WindowSize int
+
+	// MinWindowSize is the smallest window, in frames, that auto-tuning will
+	// shrink a stream's receive window to.
+	MinWindowSize int
+
+	// MaxWindowSize is the largest window, in frames, that auto-tuning will grow
+	// a stream's receive window to. Unlike WindowSize, this isn't limited to
+	// 255. If <=0, auto-tuning is disabled and streams stick with WindowSize.
+	// Only used if the other end supports protocol version 3 or above.
+	MaxWindowSize int
+
+	// SessionWindowSize is how many frames to queue across all streams on a
+	// session, used to bound memory use regardless of the number of streams. If
+	// <=0, the session window is unlimited. Only enforced if the other end
+	// supports protocol version 3 or above.
+	SessionWindowSize int
+
+	// MaxStreamsPerConn limits the number of streams that a dialer opens per
+	// physical connection. If 0, defaults to max uint32.
+	MaxStreamsPerConn uint32
+
+	// NumSessions is how many sessions (physical connections) a dialer keeps
+	// open at once. Spreading streams across several connections avoids one
+	// congested connection holding up all streams. Sessions that fail or go
+	// away are replaced automatically as new streams are dialed. Defaults to 1.
+	NumSessions int
+
+	// Placement decides which of a dialer's sessions new streams go on when
+	// NumSessions > 1. Defaults to RoundRobin().
+	Placement Placement
+
+	// KeepAliveInterval is how frequently to ping the other end. If no pong
+	// comes back within KeepAliveTimeout, the session is considered dead and is
+	// closed along with all of its streams (which fail with
+	// ErrKeepAliveTimeout). If <=0, keepalives are disabled. Keepalives are only
+	// sent if the other end supports protocol version 2 or above.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveTimeout is how long to wait for a pong before giving up on the
+	// session. If <=0, defaults to 3 x KeepAliveInterval.
+	KeepAliveTimeout time.Duration
+
+	// CloseTimeout is how long a closed stream keeps trying to send data that's
+	// still buffered before giving up. Defaults to DefaultCloseTimeout.
+	CloseTimeout time.Duration
+
+	// Pool is the BufferPool to use. Defaults to a new BufferPool of
+	// DefaultBufferPoolSize.
+	Pool BufferPool
+
+	// Logger is used for logging. Defaults to a golog logger for "connmux".
+	Logger golog.Logger
+
+	// StreamFilter, if set, decides whether to accept streams that the other
+	// end opens before they're returned from Listener.Accept or
+	// Session.AcceptStream. Returning anything other than RefuseNone refuses the
+	// stream, in which case opening it fails with a *StreamRefusedError
+	// carrying the returned code. The stream's Metadata is already available
+	// to StreamFilter. StreamFilter is called synchronously, so it should
+	// return quickly. Only used if the other end supports protocol version 4
+	// or above.
+	StreamFilter func(s Stream) RefuseCode
+
+	// AcceptBacklog is how many streams opened by the other end of a session
+	// can wait to be accepted, either with Listener.Accept or with
+	// Session.AcceptStream. Once the backlog is full, further streams are
+	// refused with RefuseOverloaded (before protocol version 4, streams can't be
+	// refused, so the session stops reading until there's room). Defaults to
+	// DefaultAcceptBacklog.
+	AcceptBacklog int
+
+	// StreamPriority is the priority that new streams start out with (see
+	// Stream.SetPriority). Defaults to DefaultStreamPriority.
+	StreamPriority int
+
+	// Hooks, if set, get notified about session and stream lifecycle events.
+	Hooks Hooks
+
+	// MinProtocolVersion is the oldest protocol version that sessions will
+	// speak. Sessions with peers that only support older versions fail with
+	// ErrVersionRejected. Defaults to the oldest supported version.
+	MinProtocolVersion byte
+
+	// MaxProtocolVersion is the newest protocol version that sessions will
+	// speak, which is useful for pinning a protocol version during a rollout.
+	// If 0 or newer than the newest supported version, defaults to the newest
+	// supported version.
+	MaxProtocolVersion byte
+}
+
+// withDefaults returns a copy of the Config with defaults applied.
+func (cfg *Config) withDefaults() *Config {
+	result := &Config{}
+	if cfg != nil {
+		*result = *cfg
+	}
+	if result.WindowSize <= 0 {
+		result.WindowSize = DefaultWindowSize
+	} else if result.WindowSize > maxWindowSize {
+		result.WindowSize = maxWindowSize
+	}
+	if result.MaxStreamsPerConn <= 0 || result.MaxStreamsPerConn > maxID {
+		result.MaxStreamsPerConn = maxID
+	}
+	if result.NumSessions <= 0 {
+		result.NumSessions = 1
+	}
+	if result.Placement == nil {
+		result.Placement = RoundRobin()
+	}
+	if result.KeepAliveTimeout <= 0 {
+		result.KeepAliveTimeout = 3 * result.KeepAliveInterval
+	}
+	if result.CloseTimeout <= 0 {
+		result.CloseTimeout = DefaultCloseTimeout
+	}
+	if result.AcceptBacklog <= 0 {
+		result.AcceptBacklog = DefaultAcceptBacklog
+	}
+	if result.StreamPriority <= 0 {
+		result.StreamPriority = DefaultStreamPriority
+	}
+	if result.Pool == nil {
+		result.Pool = NewBufferPool(DefaultBufferPoolSize)
+	}
+	if result.Logger == nil {
+		result.Logger = log
+	}
+	if result.Hooks == nil {
+		result.Hooks = NoopHooks{}
+	}
+	if result.MinProtocolVersion < minProtocolVersion {
+		result.MinProtocolVersion = minProtocolVersion
+	}
+	if result.MaxProtocolVersion == 0 || result.MaxProtocolVersion > maxProtocolVersion {
+		result.MaxProtocolVersion = maxProtocolVersion
+	}
+	return result
+}
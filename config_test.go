@@ -0,0 +1,31 @@
+package connmux
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	cfg := (*Config)(nil).withDefaults()
+	assert.Equal(t, DefaultWindowSize, cfg.WindowSize)
+	assert.EqualValues(t, maxID, cfg.MaxStreamsPerConn)
+	assert.Equal(t, DefaultCloseTimeout, cfg.CloseTimeout)
+	assert.NotNil(t, cfg.Pool)
+	assert.NotNil(t, cfg.Logger)
+	assert.NotNil(t, cfg.Hooks)
+	assert.EqualValues(t, minProtocolVersion, cfg.MinProtocolVersion)
+	assert.EqualValues(t, maxProtocolVersion, cfg.MaxProtocolVersion)
+
+	orig := &Config{
+		WindowSize:         1000,
+		KeepAliveInterval:  10 * time.Second,
+		MaxProtocolVersion: 100,
+	}
+	cfg = orig.withDefaults()
+	assert.Equal(t, maxWindowSize, cfg.WindowSize, "Window size should be capped to what fits in session start")
+	assert.Equal(t, 30*time.Second, cfg.KeepAliveTimeout)
+	assert.EqualValues(t, maxProtocolVersion, cfg.MaxProtocolVersion, "Max protocol version should be capped to the newest supported version")
+	assert.Equal(t, 1000, orig.WindowSize, "Original config shouldn't have been modified")
+}
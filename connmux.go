@@ -19,6 +19,24 @@
 //
 //      client --> start of session --> server
 //
+//   Stream open (version 4 and above)
+//
+//      client -->   syn   --> server
+//      client <-- syn-ack <-- server (stream accepted, data can flow)
+//
+//      or
+//
+//      client -->   syn   --> server
+//      client <-- refuse  <-- server (stream refused with a reason code)
+//
+//   From version 6 on, the syn can carry metadata (key/value pairs) that the
+//   server gets before any of the stream's data.
+//
+//   Before version 4, streams are opened implicitly by the first frame that
+//   arrives for a new stream id. From version 4 on, frames for stream ids that
+//   haven't been opened with a syn are dropped, and the server can open streams
+//   to the client the same way.
+//
 //   Write
 //
 //      client --> frame --> server
@@ -33,6 +51,33 @@
 //      client --> frame --> server
 //      ... etc ...
 //
+//   With protocol version 3 and above, the window is counted in bytes rather
+//   than frames. Instead of acking each frame, the receiver grants the sender
+//   more bytes of credit with window update frames as the application consumes
+//   data.
+//
+//      client --> frame --> server
+//      client --> frame --> server
+//      ... continue up to window (in bytes)
+//      client <-- window update (# of bytes read by application) <-- server
+//      client --> frame --> server
+//      ... etc ...
+//
+//   Version 3 also limits how many bytes can be outstanding across all of a
+//   session's streams. Each end advertises its session window with a window
+//   update for stream id 0 right after the session starts and grants more
+//   session-level credit the same way as it reads data from any stream. Frames
+//   can only be sent if there's enough credit for both the stream and the
+//   session.
+//
+//      client <-- window update (stream 0, session window) <-- server
+//      client --> frame (stream 1) --> server
+//      client --> frame (stream 2) --> server
+//      ... continue up to stream or session window (in bytes)
+//      client <-- window update (stream 1) <-- server
+//      client <-- window update (stream 0) <-- server
+//      ... etc ...
+//
 //   Read (parallel to write)
 //
 //      client <-- frame <-- server
@@ -47,19 +92,73 @@
 //      client <-- frame <-- server
 //      ... etc ...
 //
+//   Half-close (either side can initiate)
+//
+//      client --> frame --> server
+//      client -->  fin  --> server (server reads io.EOF after pending data)
+//      client <-- frame <-- server (server can keep writing)
+//      client <-- frame <-- server
+//      client <--  rst  <-- server
+//
+//   With protocol version 5 and above, rst frames carry a code and a short
+//   reason that tell the other end why the stream was closed, for example
+//   because buffered data timed out or the application gave up on the stream.
+//
+//   Keepalive (either side can initiate, parallel to everything else)
+//
+//      client --> ping --> server
+//      client <-- pong <-- server
+//      ... if no pong arrives within the keepalive timeout, the session is
+//          considered dead and closed
+//
+//   Graceful shutdown (either side can initiate)
+//
+//      client <-- goaway <-- server (client stops opening new streams)
+//      ... existing streams continue until closed
+//      client <-- close  <-- server (once all streams are done)
+//
 // Wire format:
 //
-//   start of session, 11 bytes
+//   start of session, 11 bytes (12 bytes for version 2 and above)
 //
-//     \0cmstart\0<version><window>
+//     \0cmstart\0<version><window>[<minversion>]
 //
 //       \0cmstart\0 - hardcoded sequence beginning and ending with \0 (NUL)
 //                     byte that indicates beginning of session
 //
-//       version     - 1 byte, the version of the protocol (currently 1)
+//       version     - 1 byte, the highest version of the protocol that the
+//                     client supports
 //
 //       window      - 1 byte, the size of the transmit window, expressed in
-//                     # of frames
+//                     # of frames. With byte-based flow control, the initial
+//                     window is this many maximum-sized frames worth of bytes
+//                     (at least 2).
+//
+//       minversion  - 1 byte, the lowest version of the protocol that the
+//                     client supports. Only sent if version >= 2.
+//
+//   session start reply, 1 byte (only sent if client's version >= 2)
+//
+//     <version>
+//
+//       version     - 1 byte, the version of the protocol chosen by the
+//                     server, or 0 if the server doesn't support any of the
+//                     client's versions (in which case it closes the
+//                     connection).
+//
+//   Version 1 clients don't negotiate, the server simply speaks version 1 to
+//   them.
+//
+//   protocol versions
+//
+//     1 - data, ack and rst frames
+//     2 - adds session start negotiation plus fin, ping, pong and goaway frames
+//     3 - replaces acks with window update frames for byte-based flow control
+//         and adds a session-level window
+//     4 - adds syn, syn-ack and refuse frames for explicitly opening streams,
+//         which also allows the server to open streams
+//     5 - adds a close code and reason to rst frames
+//     6 - adds stream metadata to syn frames
 //
 //
 //   data and control frames (positional, not delimited), maximum 8198 bytes
@@ -70,22 +169,92 @@
 //                                0 = data frame
 //                                1 = ack
 //                                2 = rst (close connection)
+//                                3 = fin (close write side of connection)
+//                                4 = ping (session keepalive)
+//                                5 = pong (response to ping)
+//                                6 = goaway (stop opening new streams)
+//                                7 = window update (grant more send credit)
+//                                8 = syn (open stream)
+//                                9 = syn-ack (stream accepted)
+//                               10 = refuse (stream refused)
 //
 //       SID (stream id)    - 3 bytes, unique identifier for stream.
 //                                (last field for non-data messages)
+//                                Streams opened by the client have odd ids
+//                                starting at 1, streams opened by the server
+//                                have even ids starting at 2. Stream id 0
+//                                refers to the session as a whole.
+//                                For ping and pong, this is an opaque value
+//                                that the pong echoes back from the ping.
 //
 //       DLEN (data length) - 2 bytes, length of data section
 //
 //       DATA               - Up to 8192 bytes, the data being transmitted
+//
+//   window update frames (positional, not delimited), 8 bytes
+//
+//     <T><SID><INCREMENT>
+//
+//       INCREMENT          - 4 bytes, the # of bytes of additional send credit
+//                            being granted for the stream (or the session if
+//                            SID is 0)
+//
+//   refuse frames (positional, not delimited), 8 bytes
+//
+//     <T><SID><CODE>
+//
+//       CODE               - 4 bytes, the reason why the stream was refused
+//                            (see RefuseCode)
+//
+//   rst frames with protocol version 5 and above (positional, not delimited),
+//   9 to 264 bytes
+//
+//     <T><SID><CODE><RLEN>[<REASON>]
+//
+//       CODE               - 4 bytes, why the stream was closed
+//                                0 = normal
+//                                1 = canceled by the end that opened it
+//                                2 = timed out sending buffered data
+//                                3 = refused by the application
+//                                4 = internal error in the application
+//                            Other codes are application-specific (see
+//                            CloseCode).
+//
+//       RLEN               - 1 byte, length of the reason
+//
+//       REASON             - Up to 255 bytes, a human-readable explanation
+//                            (UTF-8)
+//
+//   Before version 5, rst frames consist of just <T><SID>.
+//
+//   syn frames with protocol version 6 and above (positional, not delimited),
+//   6 to 4102 bytes
+//
+//     <T><SID><MLEN>[<METADATA>]
+//
+//       MLEN               - 2 bytes, length of the metadata
+//
+//       METADATA           - Up to 4096 bytes, a sequence of entries
+//
+//         <KLEN><KEY><VLEN><VALUE>
+//
+//           KLEN           - 1 byte, length of the key
+//           KEY            - the key
+//           VLEN           - 2 bytes, length of the value
+//           VALUE          - the value
+//
+//   Before version 6, syn frames consist of just <T><SID>.
 package connmux
 
 import (
+	"context"
 	"encoding/binary"
+	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/golog"
-	"github.com/oxtoacart/bpool"
 )
 
 const (
@@ -98,14 +267,53 @@ const (
 	MaxDataLen     = 8192
 	maxFrameLen    = frameHeaderLen + MaxDataLen
 
+	windowUpdateLen = 4
+	refuseCodeLen   = 4
+	closeCodeLen    = 4
+	rstHeaderLen    = closeCodeLen + 1 // code followed by reason length
+
 	// frame types
-	frameTypeData = 0
-	frameTypeACK  = 1
-	frameTypeRST  = 2
+	frameTypeData         = 0
+	frameTypeACK          = 1
+	frameTypeRST          = 2
+	frameTypeFIN          = 3
+	frameTypePING         = 4
+	frameTypePONG         = 5
+	frameTypeGOAWAY       = 6
+	frameTypeWindowUpdate = 7
+	frameTypeSYN          = 8
+	frameTypeSYNACK       = 9
+	frameTypeREFUSE       = 10
+	numFrameTypes         = 11
 
 	protocolVersion1 = 1
+	protocolVersion2 = 2
+	protocolVersion3 = 3
+	protocolVersion4 = 4
+	protocolVersion5 = 5
+	protocolVersion6 = 6
+
+	// range of protocol versions that we support
+	minProtocolVersion = protocolVersion1
+	maxProtocolVersion = protocolVersion6
+
+	// flow control modes
+	frameFlowControl flowControl = 0
+	byteFlowControl  flowControl = 1
+
+	// minimum window for byte-based flow control, which guarantees that after
+	// the receiver has sent its window updates, the sender always has enough
+	// credit for a maximum-sized frame.
+	minByteWindow = 2 * MaxDataLen
+
+	// session-level window used when none is configured, effectively unlimited
+	unlimitedSessionWindow = (1 << 31) - 1
 
 	maxID = (2 << 31) - 1
+
+	// stream ids have to fit in the 3 bytes of a frame id that aren't taken up
+	// by the frame type
+	maxStreamID = (1 << 24) - 1
 )
 
 var (
@@ -115,6 +323,15 @@ var (
 	ErrConnectionClosed = &netError{"connection closed", false, false}
 	ErrBrokenPipe       = &netError{"broken pipe", false, false}
 	ErrListenerClosed   = &netError{"listener closed", false, false}
+	ErrKeepAliveTimeout = &netError{"keepalive timeout", true, false}
+	ErrVersionRejected  = &netError{"protocol version rejected by server", false, false}
+	ErrUnsupported      = &netError{"operation not supported by peer", false, false}
+	ErrNotASession      = &netError{"connection didn't start a multiplexed session", false, false}
+
+	ErrFlowControlViolation = &netError{"peer sent more than allowed by flow control window", false, false}
+	ErrMetadataTooLarge     = &netError{"stream metadata too large", false, false}
+	ErrInvalidMetadata      = &netError{"peer sent invalid stream metadata", false, false}
+	ErrStreamIDsExhausted   = &netError{"no stream ids left on session", false, false}
 
 	binaryEncoding = binary.BigEndian
 
@@ -126,6 +343,22 @@ var (
 	largeDeadline = time.Now().Add(100000 * time.Hour)
 )
 
+// flowControl identifies how a session's streams meter the data they send. With
+// frameFlowControl, the window counts frames and receivers ACK every frame
+// they dequeue. With byteFlowControl, the window counts bytes and receivers
+// grant more credit with window updates as the application consumes data.
+type flowControl byte
+
+// byteWindow calculates the size in bytes of a window of windowSize
+// maximum-sized frames, which is never less than minByteWindow.
+func byteWindow(windowSize int) int {
+	window := windowSize * MaxDataLen
+	if window < minByteWindow {
+		window = minByteWindow
+	}
+	return window
+}
+
 // netError implements the interface net.Error
 type netError struct {
 	err       string
@@ -143,6 +376,54 @@ type Session interface {
 
 	// Wrapped() exposes access to the net.Conn that's wrapped by this Session.
 	Wrapped() net.Conn
+
+	// Shutdown() gracefully shuts down the Session by telling the other end to
+	// stop opening new streams, waiting for existing streams to finish and then
+	// closing the Session. If ctx is done first, the Session is closed anyway
+	// and ctx.Err() is returned.
+	Shutdown(ctx context.Context) error
+
+	// OpenStream() opens a new Stream to the other end. Either end can open
+	// streams, though only the dialer's end can do so if the other end speaks a
+	// protocol version below 4 (otherwise this returns ErrUnsupported). Each
+	// end has about 8 million stream ids, once they're used up this returns
+	// ErrStreamIDsExhausted and a new Session is needed.
+	OpenStream() (Stream, error)
+
+	// OpenStreamContext() is like OpenStream() but gives up once ctx is done.
+	// If ctx carries Metadata (see WithMetadata), it's sent to the other end
+	// along with the request to open the Stream. That needs the other end to
+	// speak protocol version 6 or above, otherwise this returns
+	// ErrUnsupported.
+	OpenStreamContext(ctx context.Context) (Stream, error)
+
+	// AcceptStream() waits for the other end to open a Stream and returns it.
+	// Sessions that belong to a Listener hand their streams to
+	// Listener.Accept instead and return ErrUnsupported. So do client Sessions
+	// whose other end speaks a protocol version below 4, since those servers
+	// can't open streams. If the Session closes while waiting, this returns
+	// ErrConnectionClosed.
+	AcceptStream() (Stream, error)
+
+	// NumStreams() returns the number of open streams on the Session.
+	NumStreams() int
+
+	// Stats() returns a snapshot of the Session's activity.
+	Stats() SessionStats
+
+	// CloseChan() returns a channel that is closed once the Session closes.
+	CloseChan() <-chan struct{}
+}
+
+// Listener is a net.Listener that supports multiplexing.
+type Listener interface {
+	net.Listener
+
+	// Shutdown() gracefully shuts down the Listener. It stops accepting new
+	// connections and shuts down all multiplexed Sessions as with
+	// Session.Shutdown(). If ctx is done before all Sessions have finished,
+	// they are closed anyway and ctx.Err() is returned.
+	Shutdown(ctx context.Context) error
 }
 
 // Stream is a net.Conn that also exposes access to the underlying Session
@@ -155,6 +436,77 @@ type Stream interface {
 	// Wrapped() exposes the wrapped connection (same thing as Session(), but
 	// implements netx.WrappedConn interface)
 	Wrapped() net.Conn
+
+	// ID() returns the Stream's id, which is unique within its Session.
+	ID() uint32
+
+	// Metadata() returns the Metadata that the end that opened the Stream
+	// attached to it, or nil if there isn't any. It must not be modified.
+	Metadata() Metadata
+
+	// Context() returns the context that the Stream was opened with, minus its
+	// deadline and cancellation, so that Hooks and handlers can get at values
+	// like trace spans, including values added by Hooks.OnStreamOpening. It's
+	// context.Background() for streams that the other end opened and streams
+	// opened without a context (e.g. with OpenStream), apart from what
+	// Hooks.OnStreamOpening added.
+	Context() context.Context
+
+	// CloseWithError() closes the Stream like Close(), but tells the peer why.
+	// Data that has already been written is still sent, after which the
+	// peer's reads and writes fail with a *StreamClosedError carrying code and
+	// reason (unless code is CloseNormal, which is the same as Close()).
+	// Reasons longer than 255 bytes are truncated. Peers that speak a protocol
+	// version below 5 just see the Stream closed as with Close().
+	CloseWithError(code CloseCode, reason string) error
+
+	// CloseWrite() shuts down the writing side of the Stream. Data that has
+	// already been written is still delivered, after which the peer's reads
+	// return io.EOF. Reading from the Stream continues to work. Returns
+	// ErrUnsupported if the peer speaks protocol version 1.
+	CloseWrite() error
+
+	// CloseRead() shuts down the reading side of the Stream. Subsequent reads
+	// return io.EOF and any data received from the peer is discarded. Writing
+	// to the Stream continues to work.
+	CloseRead() error
+
+	// SetPriority() sets the Stream's priority for sending data. Streams that
+	// have data to send share the Session's connection in proportion to their
+	// priorities, so a Stream with priority 32 gets to send twice as much as
+	// one with priority 16. Priorities below 1 are treated as 1. Streams start
+	// out with Config.StreamPriority. To give a Stream a different priority
+	// from the start, set it before writing any data. Only affects what this
+	// end sends.
+	SetPriority(priority int)
+
+	// Priority() returns the Stream's current priority.
+	Priority() int
+
+	// Stats() returns a snapshot of the Stream's activity.
+	Stats() StreamStats
+
+	// WriteFrame() is like Write() but takes ownership of b instead of copying
+	// it. b must be a buffer obtained from the Get() method of the Session's
+	// BufferPool and holding no more than MaxDataLen bytes. The Stream returns
+	// b to the pool once it has been sent, so callers must not touch b after
+	// calling WriteFrame().
+	WriteFrame(b []byte) (int, error)
+
+	// ReadFrame() is like Read() but returns the next chunk of received data in
+	// a buffer from the Session's BufferPool instead of copying it into a buffer
+	// supplied by the caller. The caller owns the returned buffer and should Put
+	// it back to the pool once done with it. Returns io.EOF once the peer has
+	// finished writing.
+	ReadFrame() ([]byte, error)
+
+	// ReadFrom() reads from the given io.Reader directly into frames, so that
+	// io.Copy to a Stream doesn't copy the data an extra time.
+	io.ReaderFrom
+
+	// WriteTo() writes received frames directly to the given io.Writer, so that
+	// io.Copy from a Stream doesn't copy the data an extra time.
+	io.WriterTo
 }
 
 // BufferPool is a pool of reusable buffers
@@ -168,29 +520,82 @@ type BufferPool interface {
 	Get() []byte
 
 	// Put returns a buffer back to the pool, indicating that it is safe to
-	// reuse.
+	// reuse. Only buffers that came from the pool may be put back, and only
+	// once.
 	Put([]byte)
+
+	// Stats returns a snapshot of how the pool is being used.
+	Stats() BufferPoolStats
+}
+
+// BufferPoolStats is a snapshot of how a BufferPool is being used.
+type BufferPoolStats struct {
+	// Hits counts the buffers that were reused from the pool.
+	Hits int64
+
+	// Misses counts the buffers that had to be allocated because the pool was
+	// empty.
+	Misses int64
+
+	// Outstanding is the number of buffers that have been gotten from the pool
+	// but not put back yet.
+	Outstanding int64
+
+	// Pooled is the number of buffers currently available in the pool.
+	Pooled int
 }
 
 // NewBufferPool constructs a BufferPool with the given maximumSize
 func NewBufferPool(maxSize int) BufferPool {
-	return &bufferPool{bpool.NewBytePool(maxSize, maxFrameLen)}
+	return &bufferPool{buffers: make(chan []byte, maxSize)}
 }
 
+// bufferPool is a leaky pool of buffers in the form of a bounded channel.
 type bufferPool struct {
-	pool *bpool.BytePool
+	hits    int64 // accessed atomically
+	misses  int64 // accessed atomically
+	puts    int64 // accessed atomically
+	buffers chan []byte
 }
 
 func (p *bufferPool) getForFrame() []byte {
-	return p.pool.Get()
+	select {
+	case b := <-p.buffers:
+		atomic.AddInt64(&p.hits, 1)
+		return b
+	default:
+		atomic.AddInt64(&p.misses, 1)
+		return make([]byte, maxFrameLen)
+	}
 }
 
 func (p *bufferPool) Get() []byte {
-	return p.pool.Get()[:MaxDataLen]
+	return p.getForFrame()[:MaxDataLen]
 }
 
 func (p *bufferPool) Put(b []byte) {
-	p.pool.Put(b)
+	if cap(b) < maxFrameLen {
+		// someone tried to put back a too small buffer, it can't be one of ours
+		return
+	}
+	atomic.AddInt64(&p.puts, 1)
+	select {
+	case p.buffers <- b[:maxFrameLen]:
+		// buffer went back into pool
+	default:
+		// pool is full, discard buffer
+	}
+}
+
+func (p *bufferPool) Stats() BufferPoolStats {
+	hits := atomic.LoadInt64(&p.hits)
+	misses := atomic.LoadInt64(&p.misses)
+	return BufferPoolStats{
+		Hits:        hits,
+		Misses:      misses,
+		Outstanding: hits + misses - atomic.LoadInt64(&p.puts),
+		Pooled:      len(p.buffers),
+	}
 }
 
 func frameType(b []byte) byte {
@@ -1,10 +1,16 @@
 package connmux
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -108,114 +114,1445 @@ func TestStreamCloseRemoteAfterEcho(t *testing.T) {
 	wg.Wait()
 }
 
+func TestStreamCloseWrite(t *testing.T) {
+	l, dial, wg, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, conn.(Stream).CloseWrite()) {
+		return
+	}
+
+	_, err = conn.Write([]byte("whatever"))
+	assert.Equal(t, ErrBrokenPipe, err, "Writing after CloseWrite should fail")
+
+	// Echo server only finishes echoing once it reads io.EOF
+	b, err := ioutil.ReadAll(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, testdata, string(b))
+
+	wg.Wait()
+}
+
+func TestStreamCloseRead(t *testing.T) {
+	l, dial, wg, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	if !assert.NoError(t, conn.(Stream).CloseRead()) {
+		return
+	}
+
+	b := make([]byte, 4)
+	n, err := conn.Read(b)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+
+	// Echoes more than windowSize frames, which only works if discarded frames
+	// still get acknowledged.
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte("stop"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	wg.Wait()
+}
+
+func TestStreamCopy(t *testing.T) {
+	l, dial, wg, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	data := bytes.Repeat([]byte(testdata), 3*MaxDataLen/len(testdata))
+
+	var echoed bytes.Buffer
+	readErr := make(chan error, 1)
+	go func() {
+		_, copyErr := conn.(Stream).WriteTo(&echoed)
+		readErr <- copyErr
+	}()
+
+	n, err := conn.(Stream).ReadFrom(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, len(data), n)
+	if !assert.NoError(t, conn.(Stream).CloseWrite()) {
+		return
+	}
+
+	// Echo server only finishes echoing once it reads io.EOF
+	if !assert.NoError(t, <-readErr) {
+		return
+	}
+	assert.Equal(t, data, echoed.Bytes())
+
+	wg.Wait()
+}
+
+func TestStreamFrames(t *testing.T) {
+	l, dial, wg, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	sessionPool := conn.(*stream).pool
+	stream := conn.(Stream)
+
+	pool := NewBufferPool(10)
+	b := pool.Get()[:len(testdata)]
+	copy(b, testdata)
+	n, err := stream.WriteFrame(b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, len(testdata), n)
+
+	// Buffers that didn't come from a pool get copied instead
+	foreign := make([]byte, MaxDataLen+1, maxFrameLen)
+	n, err = stream.WriteFrame(foreign)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, len(foreign), n)
+	if !assert.NoError(t, stream.CloseWrite()) {
+		return
+	}
+
+	echoed := ""
+	for {
+		frame, readErr := stream.ReadFrame()
+		if readErr == io.EOF {
+			break
+		}
+		if !assert.NoError(t, readErr) {
+			return
+		}
+		echoed += string(frame)
+		pool.Put(frame)
+	}
+	assert.Equal(t, testdata+string(foreign), echoed)
+
+	wg.Wait()
+
+	for i := 0; i < 100; i++ {
+		assert.False(t, &sessionPool.getForFrame()[0] == &foreign[0], "Buffer that didn't come from the pool shouldn't have ended up in it")
+	}
+}
+
+func TestStats(t *testing.T) {
+	l, dial, wg, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	stream := conn.(Stream)
+
+	start := time.Now()
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.ReadFull(conn, make([]byte, len(testdata)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	stats := stream.Stats()
+	assert.EqualValues(t, len(testdata), stats.BytesSent)
+	assert.EqualValues(t, len(testdata), stats.BytesReceived)
+	assert.EqualValues(t, 1, stats.FramesSent)
+	assert.True(t, stats.FramesReceived >= 1, "Should have received echoed frames")
+	assert.Equal(t, 0, stats.QueuedFrames)
+	assert.Equal(t, 0, stats.BufferedBytes)
+	assert.False(t, stats.LastActivity.Before(start))
+
+	sessionStats := stream.Session().Stats()
+	assert.Equal(t, 1, sessionStats.Streams)
+	assert.EqualValues(t, len(testdata), sessionStats.BytesSent)
+	assert.EqualValues(t, len(testdata), sessionStats.BytesReceived)
+	assert.True(t, sessionStats.FramesSent > stats.FramesSent, "Session should also count control frames")
+	assert.True(t, sessionStats.FramesReceived > stats.FramesReceived, "Session should also count control frames")
+	assert.False(t, sessionStats.LastActivity.Before(start))
+
+	_, err = conn.Write([]byte("stop"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	wg.Wait()
+}
+
 func TestPhysicalConnCloseRemotePrematurely(t *testing.T) {
 	l, dial, _, err := echoServerAndDialer(0)
 	if !assert.NoError(t, err) {
 		return
 	}
-	defer l.Close()
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("kill"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	b := make([]byte, 4)
+	n, err := conn.Read(b)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+
+	_, err = conn.Write([]byte("whatever"))
+	assert.Equal(t, ErrBrokenPipe, err)
+
+	// Now dial again and make sure that works
+	conn, err = dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	b = make([]byte, len(testdata))
+	n, err = io.ReadFull(conn, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, testdata, string(b[:n]))
+}
+
+func TestStreamCloseLocalPrematurely(t *testing.T) {
+	l, dial, _, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Close stream immediately
+	conn.Close()
+
+	_, err = conn.Write([]byte("stop"))
+	assert.Equal(t, ErrConnectionClosed, err)
+
+	b := make([]byte, 4)
+	n, err := conn.Read(b)
+	assert.Equal(t, ErrConnectionClosed, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestPhysicalConnCloseLocalPrematurely(t *testing.T) {
+	l, dial, _, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Close physical connection immediately
+	conn.(Stream).Session().Close()
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = conn.Write([]byte("stop"))
+	assert.Equal(t, ErrBrokenPipe, err)
+
+	b := make([]byte, 4)
+	n, err := conn.Read(b)
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+
+	// Now dial again and make sure that works
+	conn, err = dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	b = make([]byte, len(testdata))
+	n, err = io.ReadFull(conn, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, testdata, string(b[:n]))
+}
+
+func TestKeepAlive(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := WrapListenerWithConfig(wrapped, &Config{
+		KeepAliveInterval: 10 * time.Millisecond,
+		KeepAliveTimeout:  50 * time.Millisecond,
+		Pool:              NewBufferPool(100),
+	})
+	defer l.Close()
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go echo(t, conn, nil)
+		}
+	}()
+
+	dial := StreamDialerWithConfig(&Config{
+		WindowSize:        windowSize,
+		KeepAliveInterval: 10 * time.Millisecond,
+		KeepAliveTimeout:  50 * time.Millisecond,
+		Pool:              NewBufferPool(100),
+	}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.(Stream).Session().Close()
+
+	// Stay idle for well past the keepalive timeout
+	time.Sleep(250 * time.Millisecond)
+
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(conn, b)
+	if !assert.NoError(t, err, "Session should have been kept alive") {
+		return
+	}
+	assert.Equal(t, testdata, string(b))
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	// Server that accepts sessions but never responds to anything after that
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				b := make([]byte, sessionStartTotalLen+1)
+				if _, readErr := io.ReadFull(conn, b); readErr == nil {
+					conn.Write([]byte{protocolVersion2})
+					io.Copy(ioutil.Discard, conn)
+				}
+				conn.Close()
+			}()
+		}
+	}()
+
+	dial := StreamDialerWithConfig(&Config{
+		WindowSize:        windowSize,
+		KeepAliveInterval: 10 * time.Millisecond,
+		KeepAliveTimeout:  50 * time.Millisecond,
+		Pool:              NewBufferPool(100),
+	}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	time.Sleep(250 * time.Millisecond)
+	b := make([]byte, 4)
+	_, err = conn.Read(b)
+	assert.Equal(t, ErrKeepAliveTimeout, err)
+
+	// Dialing again should use a new session
+	conn2, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn2.Session().Close()
+	assert.True(t, conn.Session() != conn2.Session(), "Should have used a new session")
+}
+
+func TestListenerShutdown(t *testing.T) {
+	l, dial, wg, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	echoOnce := func() bool {
+		_, writeErr := conn.Write([]byte(testdata))
+		if !assert.NoError(t, writeErr) {
+			return false
+		}
+		b := make([]byte, len(testdata))
+		_, readErr := io.ReadFull(conn, b)
+		if !assert.NoError(t, readErr) {
+			return false
+		}
+		return assert.Equal(t, testdata, string(b))
+	}
+
+	// Make sure server knows about stream
+	if !echoOnce() {
+		return
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- l.(Listener).Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Existing stream should continue to work
+	if !echoOnce() {
+		return
+	}
+
+	// New dials should try to use a new session, which fails because the
+	// listener is closed.
+	_, err = dial()
+	assert.Error(t, err, "Dialing should have required a new physical connection")
+
+	select {
+	case <-shutdownErr:
+		assert.Fail(t, "Shutdown shouldn't finish while streams are still open")
+	default:
+		// good
+	}
+
+	conn.Close()
+	wg.Wait()
+	select {
+	case err = <-shutdownErr:
+		assert.NoError(t, err)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "Shutdown should have finished once streams were closed")
+	}
+}
+
+func TestSessionShutdownTimeout(t *testing.T) {
+	l, dial, _, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = conn.(Stream).Session().Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	time.Sleep(50 * time.Millisecond)
+	_, err = conn.Write([]byte(testdata))
+	assert.Equal(t, ErrBrokenPipe, err, "Session should have been closed after timing out")
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := WrapListener(wrapped, NewBufferPool(100))
+	defer l.Close()
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go echo(t, conn, nil)
+		}
+	}()
+
+	cases := []struct {
+		minVersion      byte
+		maxVersion      byte
+		expectedVersion byte
+	}{
+		{1, 1, 1},
+		{1, 2, 2},
+		{2, 2, 2},
+		{2, 3, 3},
+		{3, 4, 4},
+		{4, 5, 5},
+		{5, 6, 6},
+		{1, 9, 6},
+		{9, 9, 0},
+	}
+	for _, c := range cases {
+		conn, dialErr := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, dialErr) {
+			return
+		}
+		version, handshakeErr := clientHandshake(conn, windowSize, c.minVersion, c.maxVersion)
+		if c.expectedVersion == 0 {
+			assert.Equal(t, ErrVersionRejected, handshakeErr, "Versions %d through %d should have been rejected", c.minVersion, c.maxVersion)
+			conn.Close()
+			continue
+		}
+		if !assert.NoError(t, handshakeErr) {
+			conn.Close()
+			continue
+		}
+		assert.Equal(t, c.expectedVersion, version, "Wrong version negotiated for %d through %d", c.minVersion, c.maxVersion)
+
+		// Make sure the session works with the negotiated version
+		s := startSession(conn, true, version, windowSize, (&Config{Pool: NewBufferPool(100)}).withDefaults(), nil, nil)
+		stream, openErr := s.OpenStream()
+		if !assert.NoError(t, openErr) {
+			s.Close()
+			continue
+		}
+		_, err = stream.Write([]byte(testdata))
+		if assert.NoError(t, err) {
+			b := make([]byte, len(testdata))
+			_, err = io.ReadFull(stream, b)
+			if assert.NoError(t, err) {
+				assert.Equal(t, testdata, string(b))
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestLegacyClient(t *testing.T) {
+	l, _, wg, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	d := newDialer(&Config{WindowSize: windowSize, Pool: NewBufferPool(100), MaxProtocolVersion: protocolVersion1}, func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	wg.Add(1)
+	conn, err := d.dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	assert.Equal(t, ErrUnsupported, conn.CloseWrite(), "Version 1 shouldn't support half-close")
+
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(conn, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, testdata, string(b))
+
+	conn.Close()
+	wg.Wait()
+}
+
+func TestPinnedProtocolVersion(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := WrapListenerWithConfig(wrapped, &Config{Pool: NewBufferPool(100), MaxProtocolVersion: protocolVersion1})
+	defer l.Close()
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go echo(t, conn, nil)
+		}
+	}()
+	dial := func(cfg *Config) (Stream, error) {
+		return StreamDialerWithConfig(cfg, func() (net.Conn, error) {
+			return net.Dial("tcp", l.Addr().String())
+		})()
+	}
+
+	// Client pinned to version 1 against a listener that only speaks version 1
+	conn, err := dial(&Config{Pool: NewBufferPool(100), MaxProtocolVersion: protocolVersion1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.EqualValues(t, protocolVersion1, conn.Session().(*session).version)
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(conn, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, testdata, string(b))
+
+	// Clients that require a newer version can't talk to the listener
+	_, err = dial(&Config{Pool: NewBufferPool(100), MinProtocolVersion: protocolVersion2})
+	assert.Equal(t, ErrVersionRejected, err)
+}
+
+func TestSessionWindow(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := WrapListenerWithConfig(wrapped, &Config{SessionWindowSize: 2, Pool: NewBufferPool(100)})
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dial := StreamDialerWithConfig(&Config{WindowSize: windowSize, SessionWindowSize: 2, Pool: NewBufferPool(100)}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+
+	// Fill up the client's session window with echoed data that we don't read
+	idle, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = idle.Write(make([]byte, 2*MaxDataLen))
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Give the echo time to arrive
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len(testdata))
+	conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+	_, err = io.ReadFull(conn, b)
+	assert.Equal(t, ErrTimeout, err, "Echo shouldn't arrive while session window is full")
+
+	// Closing the idle stream should free up the session window
+	idle.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, testdata, string(b))
+
+	// Lots of concurrent streams should all get through the limited window
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, dialErr := dial()
+			if !assert.NoError(t, dialErr) {
+				return
+			}
+			defer stream.Close()
+			data := make([]byte, 5*MaxDataLen)
+			for j := range data {
+				data[j] = byte(i + j)
+			}
+			go stream.Write(data)
+			echoed := make([]byte, len(data))
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			_, readErr := io.ReadFull(stream, echoed)
+			if assert.NoError(t, readErr) {
+				assert.Equal(t, data, echoed)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Wait for the server end of the session to close so that we don't leave
+	// sockets behind
+	idle.Session().Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, l.Shutdown(ctx))
+}
+
+func TestAutoTuning(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := WrapListenerWithConfig(wrapped, &Config{MinWindowSize: 2, MaxWindowSize: 64, Pool: NewBufferPool(100)})
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dial := StreamDialerWithConfig(&Config{WindowSize: windowSize, MinWindowSize: 2, MaxWindowSize: 64, Pool: NewBufferPool(100)}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, 200*MaxDataLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go conn.Write(data)
+	echoed := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(conn, echoed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, data, echoed)
+
+	s := conn.Session().(*session)
+	assert.True(t, s.rtt() > 0, "Should have measured round trip time")
+	rb := conn.(*stream).rb
+	rb.mx.Lock()
+	window := rb.window
+	rb.mx.Unlock()
+	assert.True(t, window >= 2*MaxDataLen && window <= 64*MaxDataLen, "Window should have stayed within bounds, was %d", window)
+
+	// Wait for the server end of the session to close so that we don't leave
+	// sockets behind
+	s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, l.Shutdown(ctx))
+}
+
+func TestDialContext(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer wrapped.Close()
+	go func() {
+		for {
+			conn, acceptErr := wrapped.Accept()
+			if acceptErr != nil {
+				return
+			}
+			// Never reply to the session start
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	dialed := make(chan struct{}, 10)
+	dial := StreamDialerContext(&Config{Pool: NewBufferPool(100)}, func(ctx context.Context) (net.Conn, error) {
+		dialed <- struct{}{}
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", wrapped.Addr().String())
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dial(ctx)
+	assert.Error(t, err, "Dialing with canceled context should fail")
+
+	// First dial gets stuck in the handshake, second dial waits for first
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, dialErr := dial(ctx)
+			errs <- dialErr
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err = <-errs:
+			assert.Equal(t, context.DeadlineExceeded, err)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "Dialing should have stopped once context was done")
+			return
+		}
+	}
+	assert.Len(t, dialed, 2, "Only one dial should have tried to establish a session at a time")
+}
+
+func TestStreamContext(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := WrapListener(wrapped, NewBufferPool(100))
+	defer l.Close()
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go echo(t, conn, nil)
+		}
+	}()
+
+	dial := StreamDialerContext(&Config{Pool: NewBufferPool(100)}, func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	})
+	type key struct{}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), key{}, "value"), time.Minute)
+	conn, err := dial(ctx)
+	cancel()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.EqualValues(t, 1, conn.ID())
+	assert.Equal(t, "value", conn.Context().Value(key{}), "Stream's context should keep the dialing context's values")
+	assert.NoError(t, conn.Context().Err(), "Stream's context shouldn't be canceled along with the dialing context")
+	_, hasDeadline := conn.Context().Deadline()
+	assert.False(t, hasDeadline, "Stream's context shouldn't have the dialing context's deadline")
+}
+
+func TestStreamMetadata(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := WrapListenerWithConfig(wrapped, &Config{
+		Pool: NewBufferPool(100),
+		StreamFilter: func(s Stream) RefuseCode {
+			if s.Metadata()["tenant"] == "" {
+				return RefuseUnspecified
+			}
+			return RefuseNone
+		},
+	})
+	defer l.Close()
+	accepted := make(chan Stream, 1)
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			accepted <- conn.(Stream)
+		}
+	}()
+
+	dial := StreamDialerContext(&Config{Pool: NewBufferPool(100)}, func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	})
+	_, err = dial(context.Background())
+	assert.IsType(t, &StreamRefusedError{}, err, "StreamFilter should have seen missing metadata")
+
+	md := Metadata{"tenant": "tenant1", "host": "example.com:443"}
+	conn, err := dial(WithMetadata(context.Background(), md))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, md, conn.Metadata())
+	select {
+	case stream := <-accepted:
+		assert.Equal(t, md, stream.Metadata(), "Accepted stream should have the dialer's metadata")
+		stream.Close()
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Stream wasn't accepted")
+	}
+
+	_, err = dial(WithMetadata(context.Background(), Metadata{"big": strings.Repeat("b", MaxMetadataLen)}))
+	assert.Equal(t, ErrMetadataTooLarge, err)
+
+	// Peers that speak older protocol versions can't receive metadata
+	netConn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	version, err := clientHandshake(netConn, windowSize, protocolVersion5, protocolVersion5)
+	if !assert.NoError(t, err) {
+		netConn.Close()
+		return
+	}
+	s := startSession(netConn, true, version, windowSize, (&Config{Pool: NewBufferPool(100)}).withDefaults(), nil, nil)
+	defer s.Close()
+	_, err = s.OpenStreamContext(WithMetadata(context.Background(), md))
+	assert.Equal(t, ErrUnsupported, err)
+}
+
+func TestDialerContextHTTP(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := WrapListenerWithConfig(wrapped, &Config{Pool: NewBufferPool(100)})
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(testdata))
+	}))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: DialerContext(&Config{Pool: NewBufferPool(100)}, func(ctx context.Context) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", l.Addr().String())
+			}),
+		},
+	}
+	resp, err := client.Get("http://whatever/")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testdata, string(body))
+	}
+	client.Transport.(*http.Transport).CloseIdleConnections()
+}
+
+func TestHooks(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	serverHooks := newRecordingHooks()
+	l := WrapListenerWithConfig(wrapped, &Config{Pool: NewBufferPool(100), Hooks: serverHooks})
+	defer l.Close()
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go echo(t, conn, nil)
+		}
+	}()
+
+	clientHooks := newRecordingHooks()
+	dial := StreamDialerWithConfig(&Config{Pool: NewBufferPool(100), Hooks: clientHooks}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(conn, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, conn.Session(), <-clientHooks.started)
+	<-serverHooks.started
+	assert.Equal(t, conn, <-clientHooks.streamOpened)
+	<-serverHooks.streamOpened
+	assert.Equal(t, []string{"sessionStart", "streamOpening", "streamOpen"}, nextEvents(clientHooks, 3))
+	assert.Equal(t, []string{"sessionStart", "streamOpen"}, nextEvents(serverHooks, 2), "Only the end that opens a stream should see it opening")
+
+	conn.Close()
+	assert.Nil(t, <-clientHooks.streamClosed, "Closing stream normally shouldn't report a reason")
+	assert.Nil(t, <-serverHooks.streamClosed, "Other end closing stream normally shouldn't report a reason")
+
+	// Send a frame for the closed stream, bypassing the stream itself
+	frame := make([]byte, idLen)
+	copy(frame, conn.(*stream).id)
+	setFrameType(frame, frameTypeACK)
+	conn.(*stream).session.out <- frame
+	assert.Equal(t, "ack", <-serverHooks.frameDropped, "Frame for closed stream should have been dropped")
+
+	conn2, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	<-clientHooks.streamOpened
+	<-serverHooks.streamOpened
+
+	conn.Session().Close()
+	assert.Nil(t, <-clientHooks.closed, "Closing intentionally shouldn't report an error")
+	assert.NotNil(t, <-serverHooks.closed, "Other end should have seen an error")
+	assert.Equal(t, ErrConnectionClosed, <-clientHooks.streamClosed, "Closing session intentionally should report ErrConnectionClosed for streams")
+	assert.NotNil(t, <-serverHooks.streamClosed, "Other end's streams should have seen an error")
+	assert.Equal(t, "sessionClose", lastEvent(clientHooks), "Session should have closed after its streams")
+	assert.Equal(t, "sessionClose", lastEvent(serverHooks), "Other end's session should have closed after its streams")
+	conn2.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, clientHooks.closed, 0, "OnSessionClose should only have been called once")
+}
+
+// nextEvents returns the next n events recorded by h.
+func nextEvents(h *recordingHooks, n int) []string {
+	events := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		events = append(events, <-h.events)
+	}
+	return events
+}
+
+// lastEvent returns the most recent event recorded by h.
+func lastEvent(h *recordingHooks) string {
+	last := ""
+	for {
+		select {
+		case last = <-h.events:
+		default:
+			return last
+		}
+	}
+}
+
+type recordingHooks struct {
+	started      chan Session
+	closed       chan error
+	streamOpened chan Stream
+	streamClosed chan error
+	frameDropped chan string
+	events       chan string
+}
+
+func newRecordingHooks() *recordingHooks {
+	return &recordingHooks{
+		started:      make(chan Session, 10),
+		closed:       make(chan error, 10),
+		streamOpened: make(chan Stream, 10),
+		streamClosed: make(chan error, 10),
+		frameDropped: make(chan string, 10),
+		events:       make(chan string, 100),
+	}
+}
+
+func (h *recordingHooks) OnSessionStart(s Session) {
+	h.events <- "sessionStart"
+	h.started <- s
+}
+
+func (h *recordingHooks) OnSessionClose(s Session, err error) {
+	h.events <- "sessionClose"
+	h.closed <- err
+}
+
+func (h *recordingHooks) OnStreamOpening(ctx context.Context) context.Context {
+	h.events <- "streamOpening"
+	return ctx
+}
+
+func (h *recordingHooks) OnStreamOpen(s Stream) {
+	h.events <- "streamOpen"
+	h.streamOpened <- s
+}
+
+func (h *recordingHooks) OnStreamClose(s Stream, reason error) {
+	h.events <- "streamClose"
+	h.streamClosed <- reason
+}
+
+func (h *recordingHooks) OnFrameDropped(s Session, streamID uint32, frameType string) {
+	h.events <- "frameDropped"
+	h.frameDropped <- frameType
+}
+
+func TestSessionPool(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := WrapListenerWithConfig(wrapped, &Config{Pool: NewBufferPool(100)})
+	defer l.Close()
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go echo(t, conn, nil)
+		}
+	}()
+
+	dial := StreamDialerWithConfig(&Config{Pool: NewBufferPool(100), NumSessions: 3}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+
+	// dialStreams dials n streams, giving the pool time to fill up in between,
+	// and returns how many streams ended up on each session.
+	dialStreams := func(n int) map[Session]int {
+		counts := make(map[Session]int)
+		for i := 0; i < n; i++ {
+			conn, dialErr := dial()
+			if !assert.NoError(t, dialErr) {
+				return counts
+			}
+			_, writeErr := conn.Write([]byte(testdata))
+			assert.NoError(t, writeErr)
+			b := make([]byte, len(testdata))
+			_, readErr := io.ReadFull(conn, b)
+			assert.NoError(t, readErr)
+			counts[conn.Session()]++
+			conn.Close()
+			time.Sleep(50 * time.Millisecond)
+		}
+		return counts
+	}
+
+	counts := dialStreams(12)
+	assert.Len(t, counts, 3, "Streams should have been spread across 3 sessions")
+
+	var failed Session
+	for s := range counts {
+		failed = s
+		break
+	}
+	failed.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	counts = dialStreams(12)
+	assert.Len(t, counts, 3, "Failed session should have been replaced")
+	assert.NotContains(t, counts, failed, "Failed session shouldn't be used anymore")
+}
+
+func TestStreamRefused(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var refuse int32 = 1
+	l := WrapListenerWithConfig(wrapped, &Config{
+		Pool: NewBufferPool(100),
+		StreamFilter: func(s Stream) RefuseCode {
+			if atomic.LoadInt32(&refuse) == 1 {
+				return RefuseOverloaded
+			}
+			return RefuseNone
+		},
+	})
+	defer l.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			accepted <- conn
+			go echo(t, conn, nil)
+		}
+	}()
+
+	dial := StreamDialerWithConfig(&Config{Pool: NewBufferPool(100)}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	_, err = dial()
+	if assert.IsType(t, &StreamRefusedError{}, err) {
+		assert.Equal(t, RefuseOverloaded, err.(*StreamRefusedError).Code)
+	}
+	assert.Len(t, accepted, 0, "Refused stream shouldn't have been accepted")
 
+	atomic.StoreInt32(&refuse, 0)
 	conn, err := dial()
 	if !assert.NoError(t, err) {
 		return
 	}
 	defer conn.Close()
-
-	_, err = conn.Write([]byte("kill"))
+	_, err = conn.Write([]byte(testdata))
 	if !assert.NoError(t, err) {
 		return
 	}
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(conn, b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testdata, string(b))
+	}
+	assert.Len(t, accepted, 1)
 
-	b := make([]byte, 4)
-	n, err := conn.Read(b)
-	assert.Equal(t, io.EOF, err)
-	assert.Equal(t, 0, n)
-
-	_, err = conn.Write([]byte("whatever"))
-	assert.Equal(t, ErrBrokenPipe, err)
+	// Frames for streams that were never opened shouldn't open new streams
+	stray := make([]byte, idLen)
+	binaryEncoding.PutUint32(stray, 1000)
+	setFrameType(stray, frameTypeFIN)
+	conn.Session().(*session).out <- stray
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, accepted, 1, "Stray frame shouldn't have opened a stream")
+}
 
-	// Now dial again and make sure that works
-	conn, err = dial()
+func TestSlowListenerAccept(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
 	if !assert.NoError(t, err) {
 		return
 	}
+	l := WrapListenerWithConfig(wrapped, &Config{Pool: NewBufferPool(100), AcceptBacklog: 2})
+	defer l.Close()
 
-	_, err = conn.Write([]byte(testdata))
+	dial := StreamDialerWithConfig(&Config{Pool: NewBufferPool(100)}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	conn, err := dial()
 	if !assert.NoError(t, err) {
 		return
 	}
+	defer conn.Close()
 
-	b = make([]byte, len(testdata))
-	n, err = io.ReadFull(conn, b)
+	// Nobody is accepting, but the session should keep reading, so further
+	// streams get opened until the backlog fills up and then get refused.
+	var refusedErr error
+	for i := 0; i < 10 && refusedErr == nil; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		stream, openErr := conn.Session().OpenStreamContext(ctx)
+		cancel()
+		if openErr != nil {
+			refusedErr = openErr
+			break
+		}
+		defer stream.Close()
+		assert.True(t, i < 2, "Streams beyond the backlog shouldn't have been opened")
+	}
+	if assert.IsType(t, &StreamRefusedError{}, refusedErr) {
+		assert.Equal(t, RefuseOverloaded, refusedErr.(*StreamRefusedError).Code)
+	}
+
+	accepted, err := l.Accept()
 	if !assert.NoError(t, err) {
 		return
 	}
-	assert.Equal(t, testdata, string(b[:n]))
+	go echo(t, accepted, nil)
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(conn, b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testdata, string(b))
+	}
 }
 
-func TestStreamCloseLocalPrematurely(t *testing.T) {
-	l, dial, _, err := echoServerAndDialer(0)
+func TestStreamCloseWithError(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
 	if !assert.NoError(t, err) {
 		return
 	}
+	l := WrapListenerWithConfig(wrapped, &Config{Pool: NewBufferPool(100)})
 	defer l.Close()
+	closed := make(chan struct{})
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer close(closed)
+				b := make([]byte, len(testdata))
+				if _, readErr := io.ReadFull(conn, b); readErr != nil {
+					return
+				}
+				// Data written before closing should still make it to the other end
+				if _, writeErr := conn.Write(b); writeErr == nil {
+					conn.(Stream).CloseWithError(CloseRefused, string(b))
+				}
+			}()
+		}
+	}()
 
+	dial := StreamDialerWithConfig(&Config{Pool: NewBufferPool(100)}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
 	conn, err := dial()
 	if !assert.NoError(t, err) {
 		return
 	}
-	// Close stream immediately
-	conn.Close()
+	defer conn.Close()
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
 
-	_, err = conn.Write([]byte("stop"))
-	assert.Equal(t, ErrConnectionClosed, err)
+	// Give the RST time to arrive before reading what was sent ahead of it
+	<-closed
+	time.Sleep(50 * time.Millisecond)
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(conn, b)
+	if assert.NoError(t, err, "Should have been able to read data written before the stream was closed") {
+		assert.Equal(t, testdata, string(b))
+	}
 
-	b := make([]byte, 4)
-	n, err := conn.Read(b)
-	assert.Equal(t, ErrConnectionClosed, err)
-	assert.Equal(t, 0, n)
+	expected := &StreamClosedError{Code: CloseRefused, Reason: testdata}
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, expected, err, "Read should have returned the close code and reason")
+	_, err = conn.Write([]byte(testdata))
+	assert.Equal(t, expected, err, "Write should have returned the close code and reason")
+	assert.Equal(t, "stream closed: refused: "+testdata, err.Error())
 }
 
-func TestPhysicalConnCloseLocalPrematurely(t *testing.T) {
-	l, dial, _, err := echoServerAndDialer(0)
+func TestServerInitiatedStreams(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
 	if !assert.NoError(t, err) {
 		return
 	}
+	l := WrapListenerWithConfig(wrapped, &Config{Pool: NewBufferPool(100)})
 	defer l.Close()
+	accepted := make(chan Stream, 1)
+	go func() {
+		conn, acceptErr := l.Accept()
+		if acceptErr == nil {
+			accepted <- conn.(Stream)
+		}
+	}()
 
-	conn, err := dial()
+	dial := StreamDialerWithConfig(&Config{Pool: NewBufferPool(100), AcceptBacklog: 1}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	clientStream, err := dial()
 	if !assert.NoError(t, err) {
 		return
 	}
-	// Close physical connection immediately
-	conn.(Stream).Session().Close()
-	time.Sleep(50 * time.Millisecond)
-
-	_, err = conn.Write([]byte("stop"))
-	assert.Equal(t, ErrBrokenPipe, err)
+	defer clientStream.Close()
+	serverSession := (<-accepted).Session()
 
-	b := make([]byte, 4)
-	n, err := conn.Read(b)
-	assert.Error(t, err)
-	assert.Equal(t, 0, n)
-
-	// Now dial again and make sure that works
-	conn, err = dial()
+	serverStream, err := serverSession.OpenStream()
 	if !assert.NoError(t, err) {
 		return
 	}
+	defer serverStream.Close()
+	assert.Equal(t, uint32(1), binaryEncoding.Uint32(clientStream.(*stream).id), "Client should use odd ids")
+	assert.Equal(t, uint32(2), binaryEncoding.Uint32(serverStream.(*stream).id), "Server should use even ids")
+
+	// Backlog is full, so the next stream should be refused
+	_, err = serverSession.OpenStream()
+	if assert.IsType(t, &StreamRefusedError{}, err) {
+		assert.Equal(t, RefuseOverloaded, err.(*StreamRefusedError).Code)
+	}
 
-	_, err = conn.Write([]byte(testdata))
+	acceptedStream, err := clientStream.Session().AcceptStream()
 	if !assert.NoError(t, err) {
 		return
 	}
+	defer acceptedStream.Close()
 
-	b = make([]byte, len(testdata))
-	n, err = io.ReadFull(conn, b)
+	_, err = serverStream.Write([]byte(testdata))
 	if !assert.NoError(t, err) {
 		return
 	}
-	assert.Equal(t, testdata, string(b[:n]))
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(acceptedStream, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = acceptedStream.Write(b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.ReadFull(serverStream, b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testdata, string(b))
+	}
+
+	_, err = serverSession.AcceptStream()
+	assert.Equal(t, ErrUnsupported, err, "Listener's sessions shouldn't support AcceptStream")
 }
 
 func TestConnIDExhaustion(t *testing.T) {
@@ -250,6 +1587,53 @@ func TestConnIDExhaustion(t *testing.T) {
 	assert.NoError(t, connCount.AssertDelta(4), "Opening past MaxID should have resulted in 2 connections (4 TCP sockets including server end)")
 }
 
+func TestStreamIDExhaustion(t *testing.T) {
+	l, dial, _, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	s := conn.(Stream).Session().(*session)
+	s.mx.Lock()
+	s.nextID = maxStreamID
+	s.mx.Unlock()
+
+	last, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer last.Close()
+	assert.EqualValues(t, maxStreamID, last.(Stream).ID())
+	assert.Equal(t, s, last.(Stream).Session(), "Last stream id should have been used on the same session")
+	_, err = last.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(last, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, testdata, string(b))
+
+	_, err = s.OpenStream()
+	assert.Equal(t, ErrStreamIDsExhausted, err)
+
+	next, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer next.Close()
+	assert.True(t, s != next.(Stream).Session(), "Should have used a new session once stream ids ran out")
+	assert.EqualValues(t, 1, next.(Stream).ID())
+}
+
 func doTestConnBasicFlow(t *testing.T, mux bool) {
 	l, dial, wg, err := doEchoServerAndDialer(mux, 0)
 	if !assert.NoError(t, err) {
@@ -307,7 +1691,6 @@ func doEchoServerAndDialer(mux bool, maxStreamsPerConn uint32) (net.Listener, fu
 				return
 			}
 
-			wg.Add(1)
 			go func() {
 				defer conn.Close()
 				defer wg.Done()
@@ -348,7 +1731,92 @@ func doEchoServerAndDialer(mux bool, maxStreamsPerConn uint32) (net.Listener, fu
 		dialer = Dialer(windowSize, maxStreamsPerConn, pool, dialer)
 	}
 
-	return l, dialer, &wg, nil
+	// Count connections as they're dialed so that waiting on wg can't race with
+	// the server accepting them
+	countingDialer := func() (net.Conn, error) {
+		wg.Add(1)
+		conn, dialErr := dialer()
+		if dialErr != nil {
+			wg.Done()
+		}
+		return conn, dialErr
+	}
+
+	return l, countingDialer, &wg, nil
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(10)
+	b1 := pool.Get()
+	b2 := pool.Get()
+	assert.Equal(t, BufferPoolStats{Misses: 2, Outstanding: 2}, pool.Stats())
+
+	pool.Put(b1[:10])
+	assert.Equal(t, BufferPoolStats{Misses: 2, Outstanding: 1, Pooled: 1}, pool.Stats())
+
+	pool.Put(make([]byte, 10))
+	assert.Equal(t, BufferPoolStats{Misses: 2, Outstanding: 1, Pooled: 1}, pool.Stats(), "Too small buffers should be ignored")
+
+	b3 := pool.Get()
+	assert.True(t, &b3[0] == &b1[0], "Should have reused buffer")
+	assert.Equal(t, BufferPoolStats{Hits: 1, Misses: 2, Outstanding: 2}, pool.Stats())
+
+	pool.Put(b2)
+	pool.Put(b3)
+	assert.Equal(t, BufferPoolStats{Hits: 1, Misses: 2, Pooled: 2}, pool.Stats())
+}
+
+func TestBufferPoolNoLeaks(t *testing.T) {
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	serverPool := NewBufferPool(100)
+	l := WrapListenerWithConfig(wrapped, &Config{Pool: serverPool})
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, acceptErr := l.Accept()
+		if acceptErr == nil {
+			accepted <- conn
+		}
+	}()
+
+	clientPool := NewBufferPool(100)
+	dial := StreamDialerWithConfig(&Config{Pool: clientPool}, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 0; i < 10; i++ {
+		_, err = conn.Write([]byte(testdata))
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	// Read part of the data and leave the rest buffered
+	serverConn := <-accepted
+	b := make([]byte, 1)
+	_, err = io.ReadFull(serverConn, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Once the session is gone, everything should have been returned to the
+	// pools
+	conn.(Stream).Session().Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if serverPool.Stats().Outstanding == 0 && clientPool.Stats().Outstanding == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(t, 0, serverPool.Stats().Outstanding, "Server shouldn't have leaked any buffers")
+	assert.EqualValues(t, 0, clientPool.Stats().Outstanding, "Client shouldn't have leaked any buffers")
 }
 
 func TestConcurrency(t *testing.T) {
@@ -368,7 +1836,8 @@ func TestConcurrency(t *testing.T) {
 		for {
 			conn, err := lst.Accept()
 			if err != nil {
-				t.Fatalf("Unable to accept: %v", err)
+				t.Errorf("Unable to accept: %v", err)
+				return
 			}
 			go func() {
 				echo(t, conn, pool)
@@ -424,12 +1893,12 @@ func echo(t *testing.T, conn net.Conn, pool BufferPool) {
 			// Done
 			return
 		}
-		if !assert.NoError(t, err) {
-			t.Fatal("Unable to read for echo")
+		if !assert.NoError(t, err, "Unable to read for echo") {
+			return
 		}
 		_, err = conn.Write(b[:n])
-		if !assert.NoError(t, err) {
-			t.Fatal("Unable to echo")
+		if !assert.NoError(t, err, "Unable to echo") {
+			return
 		}
 	}
 }
@@ -438,26 +1907,156 @@ func feed(t *testing.T, conn net.Conn) {
 	for i := 0; i < 10; i++ {
 		_, err := conn.Write([]byte(fmt.Sprint(i)))
 		if err != nil {
-			t.Fatal("Unable to feed")
+			t.Error("Unable to feed")
+			return
 		}
 	}
 }
 
 func BenchmarkConnMux(b *testing.B) {
+	doBenchConnMux(b, MaxDataLen)
+}
+
+// BenchmarkConnMuxSmallWrites shows the benefit of coalescing writes, since
+// lots of small frames fit into a single write to the physical connection.
+func BenchmarkConnMuxSmallWrites(b *testing.B) {
+	doBenchConnMux(b, 64)
+}
+
+func doBenchConnMux(b *testing.B, size int) {
 	_lst, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		b.Fatal(err)
 	}
-	lst := WrapListener(_lst, NewBufferPool(100))
+	serverCounts := &ioCounts{}
+	lst := WrapListener(&countingListener{_lst, serverCounts}, NewBufferPool(100))
 
+	clientCounts := &ioCounts{}
 	conn, err := Dialer(25, 0, NewBufferPool(100), func() (net.Conn, error) {
-		return net.Dial("tcp", lst.Addr().String())
+		wrapped, dialErr := net.Dial("tcp", lst.Addr().String())
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		return &countingConn{wrapped, clientCounts}, nil
 	})()
 	if err != nil {
 		b.Fatal(err)
 	}
 
-	doBench(b, lst, conn)
+	doBenchSize(b, lst, conn, size)
+	// Each read from or write to the physical connection is a syscall
+	b.ReportMetric(float64(atomic.LoadInt64(&clientCounts.writes))/float64(b.N), "writes/op")
+	b.ReportMetric(float64(atomic.LoadInt64(&serverCounts.reads))/float64(b.N), "reads/op")
+}
+
+// BenchmarkConnMuxInteractive simulates interactive traffic like SSH, where
+// several streams each exchange lots of tiny messages back and forth. This
+// shows the benefit of buffering reads, since a single read from the physical
+// connection picks up frames for many streams at once.
+func BenchmarkConnMuxInteractive(b *testing.B) {
+	streams := 10
+	size := 32
+
+	_lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	serverCounts := &ioCounts{}
+	lst := WrapListener(&countingListener{_lst, serverCounts}, NewBufferPool(100))
+	defer lst.Close()
+
+	go func() {
+		for {
+			conn, acceptErr := lst.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dial := Dialer(25, 0, NewBufferPool(100), func() (net.Conn, error) {
+		return net.Dial("tcp", lst.Addr().String())
+	})
+
+	conns := make([]net.Conn, 0, streams)
+	for i := 0; i < streams; i++ {
+		conn, dialErr := dial()
+		if dialErr != nil {
+			b.Fatal(dialErr)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	b.SetBytes(int64(size * streams))
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	wg.Add(streams)
+	for _, conn := range conns {
+		go func(conn net.Conn) {
+			defer wg.Done()
+			out := make([]byte, size)
+			in := make([]byte, size)
+			for i := 0; i < b.N; i++ {
+				_, writeErr := conn.Write(out)
+				if writeErr != nil {
+					b.Error(writeErr)
+					return
+				}
+				_, readErr := io.ReadFull(conn, in)
+				if readErr != nil {
+					b.Error(readErr)
+					return
+				}
+			}
+		}(conn)
+	}
+	wg.Wait()
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&serverCounts.reads))/float64(b.N), "reads/op")
+}
+
+// ioCounts counts how many times Read and Write are called on a net.Conn
+type ioCounts struct {
+	reads  int64
+	writes int64
+}
+
+// countingConn records reads from and writes to the wrapped net.Conn in
+// ioCounts
+type countingConn struct {
+	net.Conn
+	*ioCounts
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// countingListener wraps accepted connections in countingConns that share its
+// ioCounts
+type countingListener struct {
+	net.Listener
+	*ioCounts
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{conn, l.ioCounts}, nil
 }
 
 func BenchmarkTCP(b *testing.B) {
@@ -475,10 +2074,14 @@ func BenchmarkTCP(b *testing.B) {
 }
 
 func doBench(b *testing.B, l net.Listener, wr io.Writer) {
+	doBenchSize(b, l, wr, MaxDataLen)
+}
+
+func doBenchSize(b *testing.B, l net.Listener, wr io.Writer, size int) {
 	pool := NewBufferPool(10)
-	buf := pool.Get()
+	buf := pool.Get()[:size]
 	buf2 := pool.getForFrame()
-	b.SetBytes(MaxDataLen)
+	b.SetBytes(int64(size))
 	b.ResetTimer()
 
 	var wg sync.WaitGroup
@@ -487,16 +2090,18 @@ func doBench(b *testing.B, l net.Listener, wr io.Writer) {
 		defer wg.Done()
 		conn, err := l.Accept()
 		if err != nil {
-			b.Fatal(err)
+			b.Error(err)
+			return
 		}
 		count := 0
 		for {
 			n, err := conn.Read(buf2)
 			if err != nil {
-				b.Fatal(err)
+				b.Error(err)
+				return
 			}
 			count += n
-			if count == MaxDataLen*b.N {
+			if count == size*b.N {
 				return
 			}
 		}
@@ -0,0 +1,79 @@
+package connmux
+
+import (
+	"sync"
+)
+
+// credit tracks how much a sender is allowed to send before it has to wait for
+// the receiver to grant more. Depending on the session's flowControl, credit is
+// counted in frames (granted by ACKs) or in bytes (granted by WINDOW_UPDATEs).
+//
+// Session-level credit is shared by all of a session's streams, so anyone
+// waiting for more credit gets notified whenever some is added.
+type credit struct {
+	available int
+	changed   chan struct{}
+	mx        sync.Mutex
+}
+
+func newCredit(initial int) *credit {
+	return &credit{
+		available: initial,
+		changed:   make(chan struct{}),
+	}
+}
+
+// add grants n more units of credit and notifies everyone waiting on changes().
+func (c *credit) add(n int) {
+	c.mx.Lock()
+	c.available += n
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mx.Unlock()
+}
+
+// changes returns a channel that gets closed the next time credit is added. To
+// avoid missing notifications, call this before trying to take() credit. If c
+// is nil, this returns nil.
+func (c *credit) changes() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.changed
+}
+
+// take consumes n units of credit if that much is available, returning false
+// if there isn't enough.
+func (c *credit) take(n int) bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.available < n {
+		return false
+	}
+	c.available -= n
+	return true
+}
+
+// refund gives back n units of credit that were taken but not used, without
+// notifying anyone.
+func (c *credit) refund(n int) {
+	c.mx.Lock()
+	c.available += n
+	c.mx.Unlock()
+}
+
+// hasSome indicates whether any credit at all is available.
+func (c *credit) hasSome() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.available > 0
+}
+
+// value returns how much credit is available.
+func (c *credit) value() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.available
+}
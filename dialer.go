@@ -1,8 +1,16 @@
 package connmux
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
 	"sync"
+	"time"
+)
+
+var (
+	handshakeTimeout = 30 * time.Second
 )
 
 // Dialer is like StreamDialer but provides a function that returns a net.Conn
@@ -19,92 +27,284 @@ func Dialer(windowSize int, maxStreamsPerConn uint32, pool BufferPool, dial func
 // will multiplex everything over a single net.Conn until it encounters a read
 // or write error on that Conn. At that point, it will dial a new conn for
 // future streams, until there's a problem with that Conn, and so on and so
-// forth.
+// forth. Likewise, if either end shuts down the session gracefully (see
+// Session.Shutdown), the Dialer uses a new net.Conn for future streams while
+// existing streams continue on the old one. To spread streams across several
+// net.Conns, see Config.NumSessions.
 //
 // If a new physical connection is needed but can't be established, the dialer
-// returns the underlying dial error.
+// returns the underlying dial error. If the other end refuses to open the
+// stream (see Config.StreamFilter), the dialer returns a *StreamRefusedError.
 //
 // windowSize - how many frames to queue, used to bound memory use. Each frame
 // takes about 8KB of memory. 25 is a good default, 50 yields higher throughput,
-// more than 50 hasn't been seen to have much of an effect.
+// more than 50 hasn't been seen to have much of an effect. To size windows
+// automatically, see Config.MaxWindowSize.
 //
 // maxStreamsPerConn - limits the number of streams per physical connection. If
 //                     <=0, defaults to max uint32.
 //
 // pool - BufferPool to use
+//
+// For more options, use StreamDialerWithConfig.
 func StreamDialer(windowSize int, maxStreamsPerConn uint32, pool BufferPool, dial func() (net.Conn, error)) func() (Stream, error) {
-	if maxStreamsPerConn <= 0 || maxStreamsPerConn > maxID {
-		maxStreamsPerConn = maxID
+	return StreamDialerWithConfig(&Config{
+		WindowSize:        windowSize,
+		MaxStreamsPerConn: maxStreamsPerConn,
+		Pool:              pool,
+	}, dial)
+}
+
+// StreamDialerWithConfig is like StreamDialer but takes its options from the
+// given Config. cfg may be nil, in which case defaults are used.
+func StreamDialerWithConfig(cfg *Config, dial func() (net.Conn, error)) func() (Stream, error) {
+	d := newDialer(cfg, func(ctx context.Context) (net.Conn, error) {
+		return dial()
+	})
+	return d.dial
+}
+
+// StreamDialerContext is like StreamDialerWithConfig but dials with a context.
+// The context is passed through to the given dial function whenever a new
+// physical connection is needed. If the context is canceled or its deadline
+// expires while establishing a new session, while waiting for another caller
+// to do so or while waiting for the other end to accept the stream, dialing
+// gives up and returns ctx.Err(). Once a Stream has been
+// returned, the context no longer has any effect on it.
+func StreamDialerContext(cfg *Config, dial func(ctx context.Context) (net.Conn, error)) func(ctx context.Context) (Stream, error) {
+	d := newDialer(cfg, dial)
+	return d.dialContext
+}
+
+// DialerContext is like StreamDialerContext but provides a function with the
+// same signature as net.Dialer.DialContext, so that it can be used as
+// http.Transport.DialContext. Since all streams go to wherever the given dial
+// function connects, network and addr are ignored.
+func DialerContext(cfg *Config, dial func(ctx context.Context) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := newDialer(cfg, dial)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return d.dialContext(ctx)
 	}
-	d := &dialer{
-		doDial:           dial,
-		windowSize:       windowSize,
-		maxStreamPerConn: maxStreamsPerConn,
-		pool:             pool,
+}
+
+func newDialer(cfg *Config, dial func(ctx context.Context) (net.Conn, error)) *dialer {
+	return &dialer{
+		doDial: dial,
+		cfg:    cfg.withDefaults(),
 	}
-	return d.dial
 }
 
 type dialer struct {
-	doDial           func() (net.Conn, error)
-	windowSize       int
-	maxStreamPerConn uint32
-	pool             BufferPool
-	current          *session
-	id               uint32
-	mx               sync.Mutex
+	doDial     func(ctx context.Context) (net.Conn, error)
+	cfg        *Config
+	sessions   []*pooledSession
+	connecting chan struct{}
+	mx         sync.Mutex
+}
+
+// pooledSession is one of a dialer's sessions along with the number of streams
+// that have been opened on it.
+type pooledSession struct {
+	*session
+	opened uint32
 }
 
 func (d *dialer) dial() (Stream, error) {
-	d.mx.Lock()
-	current := d.current
-	idsExhausted := false
-	if d.id > d.maxStreamPerConn {
-		log.Debug("Exhausted maximum allowed IDs on one physical connection, will open new connection")
-		idsExhausted = true
-		d.id = 0
-	}
-
-	// TODO: support pooling of connections (i.e. keep multiple physical connections in flight)
-	if current == nil || idsExhausted {
-		var err error
-		current, err = d.startSession()
-		if err != nil {
-			return nil, err
+	return d.dialContext(context.Background())
+}
+
+func (d *dialer) dialContext(ctx context.Context) (Stream, error) {
+	for {
+		d.mx.Lock()
+		d.pruneSessions()
+		if len(d.sessions) < d.cfg.NumSessions && d.connecting == nil {
+			// Nobody's working on a new session yet, do it ourselves
+			connecting := make(chan struct{})
+			d.connecting = connecting
+			if len(d.sessions) > 0 {
+				// We can use one of the existing sessions in the meantime
+				go func() {
+					if err := d.connect(context.Background(), connecting); err != nil {
+						d.cfg.Logger.Debugf("Unable to add session to pool: %v", err)
+					}
+				}()
+			} else {
+				d.mx.Unlock()
+				if err := d.connect(ctx, connecting); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		if len(d.sessions) > 0 {
+			s := d.placeStream()
+			s.opened++
+			d.mx.Unlock()
+
+			stream, err := s.openNextStream(ctx)
+			if err == ErrStreamIDsExhausted {
+				// Another dial used up the last id after pruning, try again
+				continue
+			}
+			return stream, err
+		}
+		connecting := d.connecting
+		d.mx.Unlock()
+
+		// Wait for whoever is starting a new session and then try again
+		select {
+		case <-connecting:
+			// try again
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
-	id := d.id
-	d.id++
-	d.mx.Unlock()
+}
+
+// pruneSessions removes sessions that can't take new streams from the pool.
+// Must be called with mx held.
+func (d *dialer) pruneSessions() {
+	usable := d.sessions[:0]
+	for _, s := range d.sessions {
+		if s.opened > d.cfg.MaxStreamsPerConn {
+			d.cfg.Logger.Debug("Exhausted maximum allowed IDs on one physical connection, will open new connection")
+			continue
+		}
+		if s.streamIDsExhausted() {
+			d.cfg.Logger.Debug("Exhausted stream ids on one physical connection, will open new connection")
+			continue
+		}
+		if s.isGoingAway() {
+			d.cfg.Logger.Debug("Session is going away, will open new connection")
+			continue
+		}
+		usable = append(usable, s)
+	}
+	for i := len(usable); i < len(d.sessions); i++ {
+		d.sessions[i] = nil
+	}
+	d.sessions = usable
+}
+
+// placeStream picks the session for a new stream using the configured
+// Placement. Must be called with mx held and at least one session in the pool.
+func (d *dialer) placeStream() *pooledSession {
+	if len(d.sessions) == 1 {
+		return d.sessions[0]
+	}
+	loads := make([]SessionLoad, 0, len(d.sessions))
+	for _, s := range d.sessions {
+		loads = append(loads, s.load())
+	}
+	i := d.cfg.Placement.Place(loads)
+	if i < 0 || i >= len(d.sessions) {
+		i = 0
+	}
+	return d.sessions[i]
+}
 
-	c, _ := current.getOrCreateStream(id)
-	return c, nil
+// connect starts a new session and adds it to the pool, closing connecting
+// once it's done.
+func (d *dialer) connect(ctx context.Context, connecting chan struct{}) error {
+	_, err := d.startSession(ctx)
+	d.mx.Lock()
+	d.connecting = nil
+	close(connecting)
+	d.mx.Unlock()
+	return err
 }
 
-func (d *dialer) startSession() (*session, error) {
-	conn, err := d.doDial()
+func (d *dialer) startSession(ctx context.Context) (*session, error) {
+	conn, err := d.doDial(ctx)
 	if err != nil {
-		d.mx.Unlock()
 		return nil, err
 	}
-	sessionStart := make([]byte, sessionStartTotalLen)
-	copy(sessionStart, sessionStartBytes)
-	sessionStart[sessionStartHeaderLen] = protocolVersion1
-	sessionStart[sessionStartHeaderLen+1] = byte(d.windowSize)
-	_, writeErr := conn.Write(sessionStart)
-	if writeErr != nil {
+	version, err := clientHandshakeContext(ctx, conn, d.cfg.WindowSize, d.cfg.MinProtocolVersion, d.cfg.MaxProtocolVersion)
+	if err != nil {
 		conn.Close()
-		return nil, writeErr
+		return nil, err
+	}
+	s := startSession(conn, true, version, d.cfg.WindowSize, d.cfg, nil, d.sessionClosed)
+	d.mx.Lock()
+	d.sessions = append(d.sessions, &pooledSession{session: s})
+	d.mx.Unlock()
+	return s, nil
+}
+
+// clientHandshakeContext is like clientHandshake but gives up once ctx is
+// done.
+func clientHandshakeContext(ctx context.Context, conn net.Conn, windowSize int, minVersion byte, maxVersion byte) (byte, error) {
+	if ctx.Done() == nil {
+		// ctx can't be canceled, don't bother watching it
+		return clientHandshake(conn, windowSize, minVersion, maxVersion)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// Interrupt any pending reads and writes
+			conn.SetDeadline(time.Now())
+		case <-stop:
+			// handshake finished
+		}
+	}()
+	version, err := clientHandshake(conn, windowSize, minVersion, maxVersion)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	return version, err
+}
+
+// clientHandshake sends the session start sequence on the given conn and
+// negotiates a protocol version between minVersion and maxVersion with the
+// server.
+func clientHandshake(conn net.Conn, windowSize int, minVersion byte, maxVersion byte) (byte, error) {
+	sessionStart := make([]byte, sessionStartTotalLen, sessionStartTotalLen+1)
+	copy(sessionStart, sessionStartBytes)
+	sessionStart[sessionStartHeaderLen] = maxVersion
+	sessionStart[sessionStartHeaderLen+1] = byte(windowSize)
+	if maxVersion < protocolVersion2 {
+		// Version 1 doesn't negotiate and the server doesn't reply
+		_, err := conn.Write(sessionStart)
+		return maxVersion, err
 	}
-	d.current = startSession(conn, d.windowSize, d.pool, nil, d.sessionClosed)
-	return d.current, nil
+
+	sessionStart = append(sessionStart, minVersion)
+	_, err := conn.Write(sessionStart)
+	if err != nil {
+		return 0, err
+	}
+	reply := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	_, err = io.ReadFull(conn, reply)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	version := reply[0]
+	if version == 0 {
+		return 0, ErrVersionRejected
+	}
+	if version < minVersion || version > maxVersion {
+		return 0, fmt.Errorf("server chose unsupported protocol version %d", version)
+	}
+	return version, nil
 }
 
 func (d *dialer) sessionClosed(s *session) {
 	d.mx.Lock()
-	if d.current == s {
-		log.Debug("Current session no longer usable, clearing")
-		d.current = nil
+	for i, ps := range d.sessions {
+		if ps.session == s {
+			d.cfg.Logger.Debug("Session no longer usable, removing from pool")
+			d.sessions = append(d.sessions[:i], d.sessions[i+1:]...)
+			break
+		}
 	}
 	d.mx.Unlock()
 }
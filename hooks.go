@@ -0,0 +1,66 @@
+package connmux
+
+import (
+	"context"
+)
+
+// Hooks get notified about session and stream lifecycle events so that
+// applications can plug in logging, metrics and connection tracking. Hooks are
+// called synchronously, so implementations should return quickly. Embed
+// NoopHooks to only implement the methods you care about.
+type Hooks interface {
+	// OnSessionStart is called once a new session has been established, before
+	// any of its streams are opened.
+	OnSessionStart(s Session)
+
+	// OnSessionClose is called once a session has closed, after all of its
+	// streams have been closed. err is the error that caused the session to
+	// close, or nil if it was closed intentionally.
+	OnSessionClose(s Session, err error)
+
+	// OnStreamOpening is called when our end starts opening a stream, before
+	// the other end has been asked to accept it. The stream is opened with the
+	// returned context (see Stream.Context), so implementations can use it to
+	// carry state like start times through to OnStreamOpen. If the stream
+	// can't be opened, OnStreamOpen is never called.
+	OnStreamOpening(ctx context.Context) context.Context
+
+	// OnStreamOpen is called once a stream has been opened, regardless of which
+	// end opened it. Streams that are refused never get opened.
+	OnStreamOpen(s Stream)
+
+	// OnStreamClose is called once an open stream has closed. reason is nil if
+	// either end closed the stream normally. Otherwise it's the error that
+	// closed the stream's session (or ErrConnectionClosed if the session was
+	// closed intentionally), a *StreamRefusedError if we accepted the stream
+	// but then refused it because the accept backlog was full, or a
+	// *StreamClosedError if either end closed it with a CloseCode other than
+	// CloseNormal.
+	OnStreamClose(s Stream, reason error)
+
+	// OnFrameDropped is called when a frame arrives for a stream that isn't
+	// open, for example because it was already closed. frameType names the
+	// type of frame like in SessionStats.ReceivedByType.
+	OnFrameDropped(s Session, streamID uint32, frameType string)
+}
+
+// NoopHooks implements Hooks by doing nothing.
+type NoopHooks struct{}
+
+// OnSessionStart implements the method from Hooks
+func (NoopHooks) OnSessionStart(s Session) {}
+
+// OnSessionClose implements the method from Hooks
+func (NoopHooks) OnSessionClose(s Session, err error) {}
+
+// OnStreamOpening implements the method from Hooks
+func (NoopHooks) OnStreamOpening(ctx context.Context) context.Context { return ctx }
+
+// OnStreamOpen implements the method from Hooks
+func (NoopHooks) OnStreamOpen(s Stream) {}
+
+// OnStreamClose implements the method from Hooks
+func (NoopHooks) OnStreamClose(s Stream, reason error) {}
+
+// OnFrameDropped implements the method from Hooks
+func (NoopHooks) OnFrameDropped(s Session, streamID uint32, frameType string) {}
@@ -0,0 +1,80 @@
+package connmux
+
+const (
+	// how many stream ids below the highest one an idTracker keeps track of
+	idWindow = 8192
+)
+
+// idTracker remembers which stream ids have already been used so that late
+// frames for closed streams don't open them again.
+//
+// Rather than remembering every id that was ever used, which would take up
+// more and more memory the longer a session lives, it relies on ids being
+// allocated in increasing order. It remembers the highest id used so far plus
+// which of the idWindow ids below that have been used, and assumes that
+// anything older than that has been used too. Ids can arrive somewhat out of
+// order when streams are opened concurrently, but never by anywhere near
+// idWindow, so this uses a constant amount of memory without ever mistaking a
+// new stream for an old one.
+//
+// Each end of a session allocates every other id, so an idTracker only ever
+// sees ids of one parity. It keeps track of them by id/2 so that every bit of
+// the window is put to use.
+//
+// idTracker is not safe for concurrent use.
+type idTracker struct {
+	highest uint32
+	used    [idWindow / 64]uint64
+}
+
+// use records that the given id has been used and returns true, unless it was
+// already used before, in which case it returns false.
+func (t *idTracker) use(id uint32) bool {
+	if id > t.highest {
+		// Forget about the ids that are dropping out of the window
+		n, highest := id/2, t.highest/2
+		if n-highest >= idWindow {
+			t.used = [idWindow / 64]uint64{}
+		} else {
+			for i := highest + 1; i < n; i++ {
+				t.set(i, false)
+			}
+		}
+		t.highest = id
+		t.set(n, true)
+		return true
+	}
+	if (t.highest-id)/2 >= idWindow || t.isSet(id/2) {
+		return false
+	}
+	t.set(id/2, true)
+	return true
+}
+
+// isUsed indicates whether the given id has already been used.
+func (t *idTracker) isUsed(id uint32) bool {
+	if id > t.highest {
+		return false
+	}
+	return (t.highest-id)/2 >= idWindow || t.isSet(id/2)
+}
+
+// reached indicates whether ids have been used up to at least the given one,
+// meaning that it's either already been used or is about to be.
+func (t *idTracker) reached(id uint32) bool {
+	return id <= t.highest
+}
+
+func (t *idTracker) isSet(n uint32) bool {
+	i := n % idWindow
+	return t.used[i/64]&(1<<(i%64)) != 0
+}
+
+func (t *idTracker) set(n uint32, used bool) {
+	i := n % idWindow
+	if used {
+		t.used[i/64] |= 1 << (i % 64)
+	} else {
+		t.used[i/64] &^= 1 << (i % 64)
+	}
+}
@@ -0,0 +1,41 @@
+package connmux
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDTracker(t *testing.T) {
+	tracker := &idTracker{}
+	assert.False(t, tracker.isUsed(1))
+	assert.False(t, tracker.reached(1))
+	assert.True(t, tracker.use(1))
+	assert.False(t, tracker.use(1), "Using same id twice shouldn't work")
+	assert.True(t, tracker.isUsed(1))
+	assert.True(t, tracker.reached(1))
+	assert.False(t, tracker.reached(3))
+
+	// Out of order
+	assert.True(t, tracker.use(9))
+	assert.True(t, tracker.use(5))
+	assert.True(t, tracker.reached(7))
+	assert.False(t, tracker.isUsed(3))
+	assert.False(t, tracker.isUsed(7))
+	assert.True(t, tracker.use(7))
+	assert.False(t, tracker.use(5))
+
+	// Ids that fall out of the window count as used. The window covers idWindow
+	// ids of the tracker's parity.
+	assert.True(t, tracker.use(2*idWindow+11))
+	assert.True(t, tracker.isUsed(3), "Id that fell out of window should count as used")
+	assert.True(t, tracker.isUsed(11), "Id that fell out of window should count as used")
+	assert.False(t, tracker.isUsed(13))
+	assert.False(t, tracker.isUsed(2*idWindow+9), "Reused slot should have been forgotten")
+	assert.True(t, tracker.use(2*idWindow+9))
+
+	// Big jump
+	assert.True(t, tracker.use(20*idWindow+1))
+	assert.True(t, tracker.isUsed(2*idWindow+9))
+	assert.False(t, tracker.isUsed(20*idWindow-1))
+}
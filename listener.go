@@ -1,15 +1,21 @@
 package connmux
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"net"
+	"sync"
 )
 
 type listener struct {
-	wrapped net.Listener
-	pool    BufferPool
-	errCh   chan error
-	connCh  chan net.Conn
+	wrapped  net.Listener
+	cfg      *Config
+	errCh    chan error
+	connCh   chan net.Conn
+	sessions map[*session]bool
+	closed   bool
+	mx       sync.Mutex
 }
 
 // WrapListener wraps the given listener with support for multiplexing. Only
@@ -21,13 +27,27 @@ type listener struct {
 // Multiplexed sessions can only be initiated immediately after opening a
 // connection to the Listener.
 //
+// Use Shutdown() on the returned Listener to gracefully drain existing
+// multiplexed sessions, for example when redeploying servers.
+//
 // pool - BufferPool to use
-func WrapListener(wrapped net.Listener, pool BufferPool) net.Listener {
+//
+// For more options, use WrapListenerWithConfig.
+func WrapListener(wrapped net.Listener, pool BufferPool) Listener {
+	return WrapListenerWithConfig(wrapped, &Config{Pool: pool})
+}
+
+// WrapListenerWithConfig is like WrapListener but takes its options from the
+// given Config. cfg may be nil, in which case defaults are used. Since clients
+// tell the server what window size to use, cfg.WindowSize and
+// cfg.MaxStreamsPerConn are ignored.
+func WrapListenerWithConfig(wrapped net.Listener, cfg *Config) Listener {
 	l := &listener{
-		wrapped: wrapped,
-		pool:    pool,
-		connCh:  make(chan net.Conn),
-		errCh:   make(chan error),
+		wrapped:  wrapped,
+		cfg:      cfg.withDefaults(),
+		connCh:   make(chan net.Conn),
+		errCh:    make(chan error),
+		sessions: make(map[*session]bool),
 	}
 	go l.process()
 	return l
@@ -47,6 +67,9 @@ func (l *listener) Addr() net.Addr {
 }
 
 func (l *listener) Close() error {
+	l.mx.Lock()
+	l.closed = true
+	l.mx.Unlock()
 	go func() {
 		l.errCh <- ErrListenerClosed
 	}()
@@ -55,6 +78,37 @@ func (l *listener) Close() error {
 	return l.wrapped.Close()
 }
 
+func (l *listener) Shutdown(ctx context.Context) error {
+	err := l.Close()
+
+	l.mx.Lock()
+	sessions := make([]*session, 0, len(l.sessions))
+	for s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.mx.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(sessions))
+	wg.Add(len(sessions))
+	for _, s := range sessions {
+		go func(s *session) {
+			defer wg.Done()
+			if shutdownErr := s.Shutdown(ctx); shutdownErr != nil {
+				errs <- shutdownErr
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	select {
+	case shutdownErr := <-errs:
+		return shutdownErr
+	default:
+		return err
+	}
+}
+
 func (l *listener) process() {
 	for {
 		conn, err := l.wrapped.Accept()
@@ -76,9 +130,23 @@ func (l *listener) onConn(conn net.Conn) {
 	}
 	if string(b[:sessionStartHeaderLen]) == sessionStart {
 		// It's a multiplexed connection
-		// TODO: check the version
+		version, negotiateErr := negotiateVersion(conn, b[sessionStartHeaderLen], l.cfg.MinProtocolVersion, l.cfg.MaxProtocolVersion)
+		if negotiateErr != nil {
+			l.cfg.Logger.Debugf("Unable to negotiate protocol version with %v: %v", conn.RemoteAddr(), negotiateErr)
+			conn.Close()
+			return
+		}
 		windowSize := int(b[sessionStartTotalLen-1])
-		startSession(conn, windowSize, l.pool, l.connCh, nil)
+		l.mx.Lock()
+		if l.closed {
+			// Don't start new sessions once we've been closed
+			l.mx.Unlock()
+			conn.Close()
+			return
+		}
+		s := startSession(conn, false, version, windowSize, l.cfg, l.connCh, l.sessionClosed)
+		l.sessions[s] = true
+		l.mx.Unlock()
 		return
 	}
 
@@ -86,6 +154,50 @@ func (l *listener) onConn(conn net.Conn) {
 	l.connCh <- &preReadConn{conn, b}
 }
 
+// negotiateVersion picks the highest protocol version between minVersion and
+// maxVersion that the client also supports and tells the client about it.
+// Version 1 clients don't negotiate, so we just use version 1 with them if we
+// can.
+func negotiateVersion(conn net.Conn, clientMaxVersion byte, minVersion byte, maxVersion byte) (byte, error) {
+	if clientMaxVersion < protocolVersion2 {
+		if clientMaxVersion < minVersion {
+			return 0, fmt.Errorf("unsupported protocol version %d", clientMaxVersion)
+		}
+		return clientMaxVersion, nil
+	}
+
+	b := make([]byte, 1)
+	_, err := io.ReadFull(conn, b)
+	if err != nil {
+		return 0, err
+	}
+	clientMinVersion := b[0]
+	version := clientMaxVersion
+	if version > maxVersion {
+		version = maxVersion
+	}
+	if version < clientMinVersion || version < minVersion {
+		// No version in common, reject
+		version = 0
+	}
+
+	b[0] = version
+	_, err = conn.Write(b)
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, fmt.Errorf("no protocol version in common with client supporting %d through %d", clientMinVersion, clientMaxVersion)
+	}
+	return version, nil
+}
+
+func (l *listener) sessionClosed(s *session) {
+	l.mx.Lock()
+	delete(l.sessions, s)
+	l.mx.Unlock()
+}
+
 // preReadConn is a conn that takes care of the fact that we've already read a
 // little from it
 type preReadConn struct {
@@ -0,0 +1,103 @@
+package connmux
+
+import (
+	"context"
+	"sort"
+)
+
+const (
+	// MaxMetadataLen is the maximum size of a Stream's Metadata once encoded.
+	// Each entry takes up the length of its key and value plus 3 bytes.
+	MaxMetadataLen = 4096
+
+	metadataLenLen      = 2
+	metadataKeyLenLen   = 1
+	metadataValueLenLen = 2
+	maxMetadataKeyLen   = 255
+)
+
+// Metadata is a small set of key/value pairs that the end opening a Stream can
+// attach to it, for example to tell the other end where to proxy the Stream
+// to. It's sent along with the request to open the Stream (protocol version 6
+// and above), so it's available as soon as the other end accepts the Stream
+// and before any data arrives. Keys can be up to 255 bytes long and the whole
+// thing can take up to MaxMetadataLen bytes.
+type Metadata map[string]string
+
+type metadataKey struct{}
+
+// WithMetadata returns a copy of ctx that carries md. Streams opened with the
+// returned context (see StreamDialerContext and Session.OpenStreamContext)
+// send md to the other end. This replaces any Metadata that ctx already
+// carries.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFromContext returns the Metadata carried by ctx, or nil if it
+// doesn't carry any.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// encodedLen returns the number of bytes that md takes up once encoded.
+func (md Metadata) encodedLen() int {
+	result := 0
+	for key, value := range md {
+		result += metadataKeyLenLen + len(key) + metadataValueLenLen + len(value)
+	}
+	return result
+}
+
+// encode encodes md as a sequence of <KLEN><KEY><VLEN><VALUE> entries, sorted by
+// key.
+func (md Metadata) encode() ([]byte, error) {
+	if md.encodedLen() > MaxMetadataLen {
+		return nil, ErrMetadataTooLarge
+	}
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		if len(key) > maxMetadataKeyLen {
+			return nil, ErrMetadataTooLarge
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b := make([]byte, 0, md.encodedLen())
+	for _, key := range keys {
+		value := md[key]
+		b = append(b, byte(len(key)))
+		b = append(b, key...)
+		b = binaryEncoding.AppendUint16(b, uint16(len(value)))
+		b = append(b, value...)
+	}
+	return b, nil
+}
+
+// decodeMetadata decodes Metadata encoded with encode, returning nil if b is
+// empty.
+func decodeMetadata(b []byte) (Metadata, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	md := make(Metadata)
+	for len(b) > 0 {
+		keyLen := int(b[0])
+		b = b[metadataKeyLenLen:]
+		if len(b) < keyLen+metadataValueLenLen {
+			return nil, ErrInvalidMetadata
+		}
+		key := string(b[:keyLen])
+		b = b[keyLen:]
+		valueLen := int(binaryEncoding.Uint16(b))
+		b = b[metadataValueLenLen:]
+		if len(b) < valueLen {
+			return nil, ErrInvalidMetadata
+		}
+		md[key] = string(b[:valueLen])
+		b = b[valueLen:]
+	}
+	return md, nil
+}
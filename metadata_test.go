@@ -0,0 +1,44 @@
+package connmux
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataEncoding(t *testing.T) {
+	md := Metadata{
+		"host":   "example.com:443",
+		"tenant": "",
+		"trace":  strings.Repeat("t", 300),
+	}
+	b, err := md.encode()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, b, md.encodedLen())
+	decoded, err := decodeMetadata(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, md, decoded)
+	}
+
+	b, err = Metadata(nil).encode()
+	if assert.NoError(t, err) {
+		assert.Empty(t, b)
+	}
+	decoded, err = decodeMetadata(b)
+	if assert.NoError(t, err) {
+		assert.Nil(t, decoded)
+	}
+
+	_, err = Metadata{strings.Repeat("k", maxMetadataKeyLen+1): ""}.encode()
+	assert.Equal(t, ErrMetadataTooLarge, err, "Long keys shouldn't be allowed")
+	_, err = Metadata{"k": strings.Repeat("v", MaxMetadataLen)}.encode()
+	assert.Equal(t, ErrMetadataTooLarge, err, "Metadata longer than MaxMetadataLen shouldn't be allowed")
+
+	_, err = decodeMetadata([]byte{5, 'h', 'o', 's', 't'})
+	assert.Equal(t, ErrInvalidMetadata, err, "Truncated metadata should be rejected")
+	_, err = decodeMetadata([]byte{1, 'k', 0, 2, 'v'})
+	assert.Equal(t, ErrInvalidMetadata, err, "Truncated value should be rejected")
+}
@@ -0,0 +1,248 @@
+// Package oteltrace traces connmux sessions and streams with OpenTelemetry.
+//
+// Usage:
+//
+//	dial := connmux.StreamDialerContext(oteltrace.Instrument(&connmux.Config{}), dial)
+//	l := connmux.WrapListenerWithConfig(wrapped, oteltrace.Instrument(&connmux.Config{}))
+//
+// Every Session gets a "connmux.session" span that starts once the session has
+// been established and ends when it closes. The protocol version handshake
+// that establishes the session happens before the span starts, so it isn't
+// part of the span. Every Stream gets a "connmux.stream" span that ends when
+// the stream closes. On the end that opened the stream, the span starts when
+// opening began, so it includes waiting for the other end to accept the
+// stream. On the other end, it starts once the stream has been accepted. A
+// stream's span is a child of the span in the context that the stream was
+// opened with (see Stream.Context) and links to its session's span. Streams
+// opened without a span are children of their session's span.
+//
+// To have the other end's span for a stream join the trace of the span that
+// opened it, open the stream with a context returned by Inject. This sends the
+// trace context to the other end in the stream's Metadata, which needs the
+// other end to speak protocol version 6 or above.
+//
+//	stream, err := dial(oteltrace.Inject(ctx))
+//
+// Spans carry these attributes:
+//
+//	network.local.address, network.peer.address - the session's addresses
+//	connmux.stream.id                             - the stream's id
+//	connmux.bytes_sent, connmux.bytes_received    - data transferred by the
+//	                                                time the span ends
+//	connmux.close_reason                          - why the stream closed
+//	connmux.close_code                            - the CloseCode, if the
+//	                                                stream was closed with one
+//
+// Sessions and streams that close because of an error get an error status.
+package oteltrace
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/getlantern/connmux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/getlantern/connmux/oteltrace"
+
+	sessionSpanName = "connmux.session"
+	streamSpanName  = "connmux.stream"
+
+	localAddressKey  = attribute.Key("network.local.address")
+	peerAddressKey   = attribute.Key("network.peer.address")
+	streamIDKey      = attribute.Key("connmux.stream.id")
+	bytesSentKey     = attribute.Key("connmux.bytes_sent")
+	bytesReceivedKey = attribute.Key("connmux.bytes_received")
+	closeReasonKey   = attribute.Key("connmux.close_reason")
+	closeCodeKey     = attribute.Key("connmux.close_code")
+
+	normalCloseReason = "normal"
+)
+
+// openingKey is the context key under which OnStreamOpening records when
+// opening a stream began.
+type openingKey struct{}
+
+// Option configures Instrument and Inject.
+type Option func(*config)
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	propagator     propagation.TextMapPropagator
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		propagator: propagation.TraceContext{},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.tracerProvider == nil {
+		cfg.tracerProvider = otel.GetTracerProvider()
+	}
+	return cfg
+}
+
+// WithTracerProvider sets the TracerProvider that creates the spans. If not
+// set, the global TracerProvider is used.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(cfg *config) {
+		cfg.tracerProvider = tp
+	}
+}
+
+// WithPropagator sets the TextMapPropagator that carries trace context in
+// stream Metadata. If not set, W3C Trace Context is used.
+func WithPropagator(p propagation.TextMapPropagator) Option {
+	return func(cfg *config) {
+		cfg.propagator = p
+	}
+}
+
+// Inject returns a copy of ctx whose Metadata (see connmux.WithMetadata) also
+// carries ctx's trace context, so that the span for a stream opened with it on
+// the other end is a child of ctx's span. Any Metadata that ctx already
+// carries is kept.
+func Inject(ctx context.Context, opts ...Option) context.Context {
+	cfg := newConfig(opts)
+	md := make(connmux.Metadata)
+	for key, value := range connmux.MetadataFromContext(ctx) {
+		md[key] = value
+	}
+	cfg.propagator.Inject(ctx, propagation.MapCarrier(md))
+	if len(md) == 0 {
+		return ctx
+	}
+	return connmux.WithMetadata(ctx, md)
+}
+
+// Instrument returns a copy of cfg whose Hooks create spans for sessions and
+// streams (in addition to calling cfg's own Hooks, if any). Pass the result to
+// StreamDialerWithConfig, StreamDialerContext or WrapListenerWithConfig.
+func Instrument(cfg *connmux.Config, opts ...Option) *connmux.Config {
+	result := &connmux.Config{}
+	if cfg != nil {
+		*result = *cfg
+	}
+	next := result.Hooks
+	if next == nil {
+		next = connmux.NoopHooks{}
+	}
+	tcfg := newConfig(opts)
+	result.Hooks = &hooks{
+		Hooks:      next,
+		tracer:     tcfg.tracerProvider.Tracer(instrumentationName),
+		propagator: tcfg.propagator,
+		sessions:   make(map[connmux.Session]trace.Span),
+		streams:    make(map[connmux.Stream]trace.Span),
+	}
+	return result
+}
+
+// hooks creates spans for sessions and streams before passing lifecycle events
+// on to the wrapped Hooks.
+type hooks struct {
+	connmux.Hooks
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	sessions   map[connmux.Session]trace.Span
+	streams    map[connmux.Stream]trace.Span
+	mx         sync.Mutex
+}
+
+func (h *hooks) OnSessionStart(s connmux.Session) {
+	_, span := h.tracer.Start(context.Background(), sessionSpanName,
+		trace.WithAttributes(
+			localAddressKey.String(s.LocalAddr().String()),
+			peerAddressKey.String(s.RemoteAddr().String())))
+	h.mx.Lock()
+	h.sessions[s] = span
+	h.mx.Unlock()
+	h.Hooks.OnSessionStart(s)
+}
+
+func (h *hooks) OnSessionClose(s connmux.Session, err error) {
+	h.mx.Lock()
+	span := h.sessions[s]
+	delete(h.sessions, s)
+	h.mx.Unlock()
+	if span != nil {
+		stats := s.Stats()
+		span.SetAttributes(
+			bytesSentKey.Int64(stats.BytesSent),
+			bytesReceivedKey.Int64(stats.BytesReceived))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+	h.Hooks.OnSessionClose(s, err)
+}
+
+func (h *hooks) OnStreamOpening(ctx context.Context) context.Context {
+	return context.WithValue(h.Hooks.OnStreamOpening(ctx), openingKey{}, time.Now())
+}
+
+func (h *hooks) OnStreamOpen(s connmux.Stream) {
+	h.mx.Lock()
+	sessionSpan := h.sessions[s.Session()]
+	h.mx.Unlock()
+
+	ctx := s.Context()
+	if md := s.Metadata(); len(md) > 0 && !trace.SpanContextFromContext(ctx).IsValid() {
+		// Pick up the trace context sent by the other end, if any (the end that
+		// opened the stream already has it in ctx)
+		ctx = h.propagator.Extract(ctx, propagation.MapCarrier(md))
+	}
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(streamIDKey.Int64(int64(s.ID()))),
+	}
+	if openingStarted, ok := ctx.Value(openingKey{}).(time.Time); ok {
+		opts = append(opts, trace.WithTimestamp(openingStarted))
+	}
+	if sessionSpan != nil {
+		if trace.SpanContextFromContext(ctx).IsValid() {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sessionSpan.SpanContext()}))
+		} else {
+			ctx = trace.ContextWithSpan(ctx, sessionSpan)
+		}
+	}
+	_, span := h.tracer.Start(ctx, streamSpanName, opts...)
+	h.mx.Lock()
+	h.streams[s] = span
+	h.mx.Unlock()
+	h.Hooks.OnStreamOpen(s)
+}
+
+func (h *hooks) OnStreamClose(s connmux.Stream, reason error) {
+	h.mx.Lock()
+	span := h.streams[s]
+	delete(h.streams, s)
+	h.mx.Unlock()
+	if span != nil {
+		stats := s.Stats()
+		span.SetAttributes(
+			bytesSentKey.Int64(stats.BytesSent),
+			bytesReceivedKey.Int64(stats.BytesReceived))
+		if reason == nil {
+			span.SetAttributes(closeReasonKey.String(normalCloseReason))
+		} else {
+			span.SetAttributes(closeReasonKey.String(reason.Error()))
+			if closedErr, ok := reason.(*connmux.StreamClosedError); ok {
+				span.SetAttributes(closeCodeKey.Int64(int64(closedErr.Code)))
+			}
+			span.SetStatus(codes.Error, reason.Error())
+		}
+		span.End()
+	}
+	h.Hooks.OnStreamClose(s, reason)
+}
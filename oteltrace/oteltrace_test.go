@@ -0,0 +1,125 @@
+package oteltrace
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/connmux"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	testdata = "Hello Dear World"
+)
+
+func TestInstrument(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := connmux.WrapListenerWithConfig(wrapped, Instrument(&connmux.Config{
+		StreamFilter: func(s connmux.Stream) connmux.RefuseCode {
+			// Take a while to accept streams
+			time.Sleep(50 * time.Millisecond)
+			return connmux.RefuseNone
+		},
+	}, WithTracerProvider(tp)))
+	defer l.Close()
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				b := make([]byte, len(testdata))
+				if _, readErr := io.ReadFull(conn, b); readErr == nil {
+					conn.Write(b)
+					conn.(connmux.Stream).CloseWithError(connmux.CloseRefused, "done")
+				}
+			}()
+		}
+	}()
+
+	dial := connmux.StreamDialerContext(Instrument(&connmux.Config{}, WithTracerProvider(tp)), func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	conn, err := dial(Inject(ctx))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.ReadFull(conn, make([]byte, len(testdata)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Read(make([]byte, 1))
+	assert.IsType(t, &connmux.StreamClosedError{}, err)
+	parent.End()
+	conn.Session().Close()
+	time.Sleep(100 * time.Millisecond)
+
+	var sessionSpans, streamSpans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case sessionSpanName:
+			sessionSpans = append(sessionSpans, span)
+		case streamSpanName:
+			streamSpans = append(streamSpans, span)
+		}
+	}
+	assert.Len(t, sessionSpans, 2, "Should have traced both ends of the session")
+	if !assert.Len(t, streamSpans, 2, "Should have traced both ends of the stream") {
+		return
+	}
+
+	for _, span := range streamSpans {
+		attrs := attributes(span)
+		assert.EqualValues(t, 1, attrs[streamIDKey].AsInt64())
+		assert.EqualValues(t, len(testdata), attrs[bytesReceivedKey].AsInt64())
+		assert.Equal(t, "stream closed: refused: done", attrs[closeReasonKey].AsString())
+		assert.EqualValues(t, connmux.CloseRefused, attrs[closeCodeKey].AsInt64())
+		assert.Equal(t, codes.Error, span.Status().Code)
+	}
+
+	var clientSpan, serverSpan sdktrace.ReadOnlySpan
+	for _, span := range streamSpans {
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID(), "Both ends' stream spans should be children of the request span")
+		if span.Parent().IsRemote() {
+			serverSpan = span
+		} else {
+			clientSpan = span
+		}
+	}
+	assert.NotNil(t, serverSpan, "Server's stream span should have picked up the trace context from the client")
+	if assert.NotNil(t, clientSpan) && serverSpan != nil {
+		assert.True(t, clientSpan.StartTime().Before(serverSpan.StartTime()), "Client's stream span should have started before the server accepted the stream")
+		assert.EqualValues(t, len(testdata), attributes(clientSpan)[bytesSentKey].AsInt64())
+		if assert.Len(t, clientSpan.Links(), 1) {
+			assert.True(t, clientSpan.Links()[0].SpanContext.Equal(sessionSpans[0].SpanContext()) ||
+				clientSpan.Links()[0].SpanContext.Equal(sessionSpans[1].SpanContext()), "Client's stream span should link to its session span")
+		}
+	}
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	result := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		result[kv.Key] = kv.Value
+	}
+	return result
+}
@@ -0,0 +1,68 @@
+package connmux
+
+import (
+	"sync/atomic"
+)
+
+// SessionLoad describes how busy one of a dialer's pooled sessions is.
+type SessionLoad struct {
+	// Streams is the number of open streams on the session.
+	Streams int
+
+	// BufferedBytes is the number of bytes that have been written to the
+	// session's streams but not yet sent.
+	BufferedBytes int
+}
+
+// Placement decides which of a dialer's pooled sessions a new stream goes on
+// (see Config.NumSessions).
+type Placement interface {
+	// Place returns the index of the session to use given the current loads of
+	// all usable sessions. loads always contains at least one element.
+	Place(loads []SessionLoad) int
+}
+
+// PlacementFunc adapts an ordinary function to the Placement interface.
+type PlacementFunc func(loads []SessionLoad) int
+
+// Place implements the method from Placement
+func (fn PlacementFunc) Place(loads []SessionLoad) int {
+	return fn(loads)
+}
+
+// RoundRobin returns a Placement that cycles through sessions in turn.
+func RoundRobin() Placement {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+func (rr *roundRobin) Place(loads []SessionLoad) int {
+	return int((atomic.AddUint32(&rr.next, 1) - 1) % uint32(len(loads)))
+}
+
+// LeastStreams is a Placement that picks the session with the fewest open
+// streams.
+var LeastStreams Placement = PlacementFunc(func(loads []SessionLoad) int {
+	return leastBy(loads, func(load SessionLoad) int { return load.Streams })
+})
+
+// LeastBuffered is a Placement that picks the session with the fewest bytes
+// waiting to be sent, which tends to avoid sessions whose connections are
+// congested.
+var LeastBuffered Placement = PlacementFunc(func(loads []SessionLoad) int {
+	return leastBy(loads, func(load SessionLoad) int { return load.BufferedBytes })
+})
+
+// leastBy returns the index of the first load with the smallest value.
+func leastBy(loads []SessionLoad, value func(SessionLoad) int) int {
+	best := 0
+	for i := 1; i < len(loads); i++ {
+		if value(loads[i]) < value(loads[best]) {
+			best = i
+		}
+	}
+	return best
+}
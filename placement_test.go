@@ -0,0 +1,23 @@
+package connmux
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlacement(t *testing.T) {
+	loads := []SessionLoad{
+		{Streams: 3, BufferedBytes: 10},
+		{Streams: 1, BufferedBytes: 500},
+		{Streams: 2, BufferedBytes: 0},
+	}
+
+	rr := RoundRobin()
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, i%len(loads), rr.Place(loads))
+	}
+	assert.Equal(t, 1, LeastStreams.Place(loads))
+	assert.Equal(t, 2, LeastBuffered.Place(loads))
+	assert.Equal(t, 0, LeastStreams.Place(loads[:1]))
+}
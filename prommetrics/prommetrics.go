@@ -0,0 +1,278 @@
+// Package prommetrics exports metrics about connmux sessions, streams and
+// buffer pools to Prometheus.
+//
+// Usage:
+//
+//	collector := prommetrics.NewCollector()
+//	prometheus.MustRegister(collector)
+//
+//	dial := connmux.StreamDialerWithConfig(collector.Instrument(&connmux.Config{}), dial)
+//	l := connmux.WrapListenerWithConfig(wrapped, collector.Instrument(&connmux.Config{}))
+//
+// To tell dialers and listeners apart, use a separate Collector for each and
+// register them with different labels (see prometheus.WrapRegistererWith).
+package prommetrics
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/getlantern/connmux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "connmux"
+)
+
+var (
+	sessionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "sessions"),
+		"Number of open sessions.",
+		nil, nil)
+	streamsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "streams"),
+		"Number of open streams.",
+		nil, nil)
+	framesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "frames_total"),
+		"Frames sent and received, by frame type and direction.",
+		[]string{"type", "direction"}, nil)
+	bytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "bytes_total"),
+		"Bytes sent and received including frame headers, by frame type and direction.",
+		[]string{"type", "direction"}, nil)
+	rstsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "rsts_total"),
+		"RST frames sent and received, by direction.",
+		[]string{"direction"}, nil)
+	ackLatencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "ack_latency_seconds"),
+		"How long streams waited for the other end to acknowledge sent data.",
+		nil, nil)
+	sessionErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "session_errors_total"),
+		"Sessions that closed because of an error, by cause.",
+		[]string{"cause"}, nil)
+	poolHitsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "buffer_pool", "hits_total"),
+		"Buffers that were reused from the pool.",
+		nil, nil)
+	poolMissesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "buffer_pool", "misses_total"),
+		"Buffers that had to be allocated because the pool was empty.",
+		nil, nil)
+	poolOutstandingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "buffer_pool", "outstanding"),
+		"Buffers that have been taken from the pool but not put back.",
+		nil, nil)
+	poolPooledDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "buffer_pool", "pooled"),
+		"Buffers currently available in the pool.",
+		nil, nil)
+)
+
+// Collector is a prometheus.Collector that reports on the sessions of dialers
+// and listeners whose Config it has instrumented. Metrics are gathered from
+// Session.Stats() and BufferPool.Stats() at scrape time. Counters include the
+// activity of sessions that have already closed.
+type Collector struct {
+	sessions      map[connmux.Session]bool
+	closed        connmux.SessionStats
+	sessionErrors map[string]float64
+	pools         map[connmux.BufferPool]bool
+	defaultPool   connmux.BufferPool
+	mx            sync.Mutex
+}
+
+// NewCollector constructs a new Collector.
+func NewCollector() *Collector {
+	return &Collector{
+		sessions: make(map[connmux.Session]bool),
+		closed: connmux.SessionStats{
+			SentByType:     make(map[string]connmux.FrameStats),
+			ReceivedByType: make(map[string]connmux.FrameStats),
+		},
+		sessionErrors: make(map[string]float64),
+		pools:         make(map[connmux.BufferPool]bool),
+	}
+}
+
+// Instrument returns a copy of cfg whose Hooks report to this Collector (in
+// addition to calling cfg's own Hooks, if any) and whose BufferPool is
+// monitored by this Collector. If cfg has no BufferPool, it gets one of
+// connmux.DefaultBufferPoolSize that's shared by all such Configs instrumented
+// by this Collector, so that there's something to monitor. Pass the result to
+// StreamDialerWithConfig or WrapListenerWithConfig. Instrumenting Configs that
+// share a BufferPool monitors that pool only once.
+func (c *Collector) Instrument(cfg *connmux.Config) *connmux.Config {
+	result := &connmux.Config{}
+	if cfg != nil {
+		*result = *cfg
+	}
+	next := result.Hooks
+	if next == nil {
+		next = connmux.NoopHooks{}
+	}
+	result.Hooks = &hooks{Hooks: next, c: c}
+	c.mx.Lock()
+	if result.Pool == nil {
+		if c.defaultPool == nil {
+			c.defaultPool = connmux.NewBufferPool(connmux.DefaultBufferPoolSize)
+		}
+		result.Pool = c.defaultPool
+	}
+	c.pools[result.Pool] = true
+	c.mx.Unlock()
+	return result
+}
+
+// hooks reports session lifecycle events to a Collector before passing them on
+// to the wrapped Hooks.
+type hooks struct {
+	connmux.Hooks
+	c *Collector
+}
+
+func (h *hooks) OnSessionStart(s connmux.Session) {
+	h.c.onSessionStart(s)
+	h.Hooks.OnSessionStart(s)
+}
+
+func (h *hooks) OnSessionClose(s connmux.Session, err error) {
+	h.c.onSessionClose(s, err)
+	h.Hooks.OnSessionClose(s, err)
+}
+
+func (c *Collector) onSessionStart(s connmux.Session) {
+	c.mx.Lock()
+	c.sessions[s] = true
+	c.mx.Unlock()
+}
+
+func (c *Collector) onSessionClose(s connmux.Session, err error) {
+	// OnSessionClose is called once all streams are closed, so this is the
+	// session's final snapshot
+	stats := s.Stats()
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	delete(c.sessions, s)
+	add(&c.closed, stats)
+	if err != nil {
+		c.sessionErrors[causeOf(err)]++
+	}
+}
+
+// causeOf classifies the error that closed a session.
+func causeOf(err error) string {
+	switch err {
+	case connmux.ErrKeepAliveTimeout:
+		return "keepalive_timeout"
+	case connmux.ErrFlowControlViolation:
+		return "flow_control_violation"
+	case io.EOF, io.ErrUnexpectedEOF:
+		return "eof"
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
+
+// add adds the counters from stats to total.
+func add(total *connmux.SessionStats, stats connmux.SessionStats) {
+	total.BytesSent += stats.BytesSent
+	total.BytesReceived += stats.BytesReceived
+	total.FramesSent += stats.FramesSent
+	total.FramesReceived += stats.FramesReceived
+	total.ACKs += stats.ACKs
+	total.ACKLatency += stats.ACKLatency
+	for frameType, fs := range stats.SentByType {
+		sum := total.SentByType[frameType]
+		sum.Frames += fs.Frames
+		sum.Bytes += fs.Bytes
+		total.SentByType[frameType] = sum
+	}
+	for frameType, fs := range stats.ReceivedByType {
+		sum := total.ReceivedByType[frameType]
+		sum.Frames += fs.Frames
+		sum.Bytes += fs.Bytes
+		total.ReceivedByType[frameType] = sum
+	}
+}
+
+// Describe implements the method from prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+	ch <- streamsDesc
+	ch <- framesDesc
+	ch <- bytesDesc
+	ch <- rstsDesc
+	ch <- ackLatencyDesc
+	ch <- sessionErrorsDesc
+	ch <- poolHitsDesc
+	ch <- poolMissesDesc
+	ch <- poolOutstandingDesc
+	ch <- poolPooledDesc
+}
+
+// Collect implements the method from prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mx.Lock()
+	sessions := make([]connmux.Session, 0, len(c.sessions))
+	for s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	total := connmux.SessionStats{
+		SentByType:     make(map[string]connmux.FrameStats),
+		ReceivedByType: make(map[string]connmux.FrameStats),
+	}
+	add(&total, c.closed)
+	sessionErrors := make(map[string]float64, len(c.sessionErrors))
+	for cause, count := range c.sessionErrors {
+		sessionErrors[cause] = count
+	}
+	pools := make([]connmux.BufferPool, 0, len(c.pools))
+	for p := range c.pools {
+		pools = append(pools, p)
+	}
+	c.mx.Unlock()
+
+	streams := 0
+	for _, s := range sessions {
+		stats := s.Stats()
+		streams += stats.Streams
+		add(&total, stats)
+	}
+
+	ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(len(sessions)))
+	ch <- prometheus.MustNewConstMetric(streamsDesc, prometheus.GaugeValue, float64(streams))
+	for frameType, fs := range total.SentByType {
+		ch <- prometheus.MustNewConstMetric(framesDesc, prometheus.CounterValue, float64(fs.Frames), frameType, "sent")
+		ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue, float64(fs.Bytes), frameType, "sent")
+	}
+	for frameType, fs := range total.ReceivedByType {
+		ch <- prometheus.MustNewConstMetric(framesDesc, prometheus.CounterValue, float64(fs.Frames), frameType, "received")
+		ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue, float64(fs.Bytes), frameType, "received")
+	}
+	ch <- prometheus.MustNewConstMetric(rstsDesc, prometheus.CounterValue, float64(total.SentByType["rst"].Frames), "sent")
+	ch <- prometheus.MustNewConstMetric(rstsDesc, prometheus.CounterValue, float64(total.ReceivedByType["rst"].Frames), "received")
+	ch <- prometheus.MustNewConstSummary(ackLatencyDesc, uint64(total.ACKs), total.ACKLatency.Seconds(), nil)
+	for cause, count := range sessionErrors {
+		ch <- prometheus.MustNewConstMetric(sessionErrorsDesc, prometheus.CounterValue, count, cause)
+	}
+
+	var pool connmux.BufferPoolStats
+	for _, p := range pools {
+		stats := p.Stats()
+		pool.Hits += stats.Hits
+		pool.Misses += stats.Misses
+		pool.Outstanding += stats.Outstanding
+		pool.Pooled += stats.Pooled
+	}
+	ch <- prometheus.MustNewConstMetric(poolHitsDesc, prometheus.CounterValue, float64(pool.Hits))
+	ch <- prometheus.MustNewConstMetric(poolMissesDesc, prometheus.CounterValue, float64(pool.Misses))
+	ch <- prometheus.MustNewConstMetric(poolOutstandingDesc, prometheus.GaugeValue, float64(pool.Outstanding))
+	ch <- prometheus.MustNewConstMetric(poolPooledDesc, prometheus.GaugeValue, float64(pool.Pooled))
+}
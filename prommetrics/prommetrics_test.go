@@ -0,0 +1,127 @@
+package prommetrics
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/connmux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testdata = "Hello Dear World"
+)
+
+func TestCollector(t *testing.T) {
+	collector := NewCollector()
+	reg := prometheus.NewRegistry()
+	if !assert.NoError(t, reg.Register(collector)) {
+		return
+	}
+
+	wrapped, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := connmux.WrapListenerWithConfig(wrapped, collector.Instrument(&connmux.Config{Pool: connmux.NewBufferPool(100)}))
+	defer l.Close()
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dial := connmux.StreamDialerWithConfig(collector.Instrument(&connmux.Config{}), func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.ReadFull(conn, make([]byte, len(testdata)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	metrics := gather(t, reg)
+	assert.EqualValues(t, 2, value(metrics, "connmux_sessions"), "Should have seen both ends of the session")
+	assert.EqualValues(t, 2, value(metrics, "connmux_streams"), "Should have seen both ends of the stream")
+	assert.EqualValues(t, 2, value(metrics, "connmux_frames_total", "type", "data", "direction", "sent"))
+	assert.EqualValues(t, 2, value(metrics, "connmux_frames_total", "type", "data", "direction", "received"))
+	assert.True(t, value(metrics, "connmux_bytes_total", "type", "data", "direction", "sent") > float64(2*len(testdata)), "Bytes should include headers")
+	assert.True(t, value(metrics, "connmux_buffer_pool_hits_total")+value(metrics, "connmux_buffer_pool_misses_total") > 0, "Should have used buffer pools")
+
+	conn.Session().Close()
+	time.Sleep(100 * time.Millisecond)
+
+	metrics = gather(t, reg)
+	assert.EqualValues(t, 0, value(metrics, "connmux_sessions"))
+	assert.EqualValues(t, 0, value(metrics, "connmux_streams"))
+	assert.EqualValues(t, 2, value(metrics, "connmux_frames_total", "type", "data", "direction", "sent"), "Counters should include closed sessions")
+	assert.EqualValues(t, 1, value(metrics, "connmux_session_errors_total", "cause", "eof"), "Other end should have seen an EOF")
+}
+
+func TestInstrumentPools(t *testing.T) {
+	collector := NewCollector()
+	cfg1 := collector.Instrument(nil)
+	cfg2 := collector.Instrument(&connmux.Config{})
+	assert.Equal(t, cfg1.Pool, cfg2.Pool, "Configs without a pool should share the Collector's pool")
+
+	pool := connmux.NewBufferPool(10)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, pool, collector.Instrument(&connmux.Config{Pool: pool}).Pool)
+	}
+	assert.Len(t, collector.pools, 2, "Pools should only be monitored once")
+}
+
+func gather(t *testing.T, reg *prometheus.Registry) []*dto.MetricFamily {
+	metrics, err := reg.Gather()
+	assert.NoError(t, err)
+	return metrics
+}
+
+// value finds the value of the named metric with the given label name/value
+// pairs, returning -1 if there is no such metric.
+func value(metrics []*dto.MetricFamily, name string, labels ...string) float64 {
+	for _, mf := range metrics {
+		if mf.GetName() != name {
+			continue
+		}
+	metricLoop:
+		for _, m := range mf.GetMetric() {
+			for i := 0; i < len(labels); i += 2 {
+				matched := false
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == labels[i] && lp.GetValue() == labels[i+1] {
+						matched = true
+					}
+				}
+				if !matched {
+					continue metricLoop
+				}
+			}
+			switch {
+			case m.Gauge != nil:
+				return m.GetGauge().GetValue()
+			case m.Counter != nil:
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return -1
+}
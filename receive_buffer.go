@@ -6,51 +6,136 @@ import (
 	"time"
 )
 
-// receiveBuffer buffers incoming frames. It queues up available frames in a
-// channel and makes sure that those are read in order when filling reader's
-// buffers via the read() method. It also makes sure to send an ack whenever a
-// queued frame has been fully read.
+// receiveBuffer buffers incoming frames. It queues up available frames and
+// makes sure that those are read in order when filling reader's buffers via the
+// read() method. It also makes sure to grant the sender more credit as data is
+// read.
 //
-// In order to bound memory usage, the channel holds only <windowSize> frames,
-// after which it starts back-pressuring. The sender knows not to send more
-// than <windowSize> frames so as to prevent this. Once the sender receives an
+// In order to bound memory usage, the queue holds only up to the window. The
+// sender knows not to send more than the window so as to prevent this. How the
+// window is counted depends on the session's flowControl:
+//
+// With frameFlowControl, the window is <windowSize> frames and we send an ACK
+// whenever a queued frame is dequeued for reading. Once the sender receives an
 // ACK from the receiver, it sends a subsequent frame and so on.
+//
+// With byteFlowControl, the window is <windowSize> maximum-sized frames worth
+// of bytes and we send a window update once the application has consumed half
+// of the window. Small frames are coalesced as they're queued, so memory use is
+// bounded by the window regardless of how big the sender's frames are. With
+// autoTuning, the window grows or shrinks each time we grant more credit,
+// depending on how quickly the application has been consuming data. Frames
+// also take up space in the session's sessionWindow until they've been read or
+// discarded.
+//
+// If the reading side has been closed via closeRead(), frames are discarded as
+// they arrive but still acknowledged so that the sender doesn't stall.
 type receiveBuffer struct {
-	ackFrame []byte
-	in       chan []byte
-	ack      chan []byte
-	pool     BufferPool
-	poolable []byte
-	current  []byte
-	closed   bool
-	mx       sync.RWMutex
+	received    activity
+	streamID    []byte
+	ackFrame    []byte
+	ack         chan []byte
+	closeCh     chan struct{}
+	pool        BufferPool
+	flowControl flowControl
+	window      int
+	queue       [][]byte
+	outstanding int
+	unacked     int
+	session     *sessionWindow
+	sessionHeld int
+	tuning      *autoTuning
+	sampleStart time.Time
+	sampled     int
+	avail       chan struct{}
+	poolable    []byte
+	current     []byte
+	closed      bool
+	discard     bool
+	reading     bool
+	drained     bool
+	mx          sync.Mutex
 }
 
-func newReceiveBuffer(streamID []byte, ack chan []byte, pool BufferPool, windowSize int) *receiveBuffer {
+func newReceiveBuffer(streamID []byte, ack chan []byte, closeCh chan struct{}, pool BufferPool, windowSize int, fc flowControl, session *sessionWindow, tuning *autoTuning) *receiveBuffer {
 	// Make an ackFrame for this stream id
 	ackFrame := make([]byte, len(streamID))
 	copy(ackFrame, streamID)
 	setFrameType(ackFrame, frameTypeACK)
 
+	window := windowSize
+	if fc == byteFlowControl {
+		window = byteWindow(windowSize)
+	}
+
 	return &receiveBuffer{
-		ackFrame: ackFrame,
-		in:       make(chan []byte, windowSize),
-		ack:      ack,
-		pool:     pool,
+		streamID:    streamID,
+		ackFrame:    ackFrame,
+		ack:         ack,
+		closeCh:     closeCh,
+		pool:        pool,
+		flowControl: fc,
+		window:      window,
+		session:     session,
+		tuning:      tuning,
+		sampleStart: time.Now(),
+		avail:       make(chan struct{}, 1),
 	}
 }
 
-// submit allows the session to submit a new frame to the receiveBuffer. If the
-// receiveBuffer has been closed, this is a noop.
-func (buf *receiveBuffer) submit(frame []byte) {
-	buf.mx.RLock()
-	closed := buf.closed
-	if closed {
-		buf.mx.RUnlock()
-		return
+// submit allows the session to submit a new frame to the receiveBuffer. The
+// frame holds just the data, starting at the beginning of a pooled buffer. If
+// the receiveBuffer has been closed, the frame is returned to the pool (and
+// acknowledged if we're discarding). If the sender has exceeded the stream's or
+// the session's window, this returns ErrFlowControlViolation.
+func (buf *receiveBuffer) submit(frame []byte) error {
+	buf.received.record(len(frame))
+	size := buf.sizeOf(frame)
+	buf.mx.Lock()
+	if buf.session != nil && !buf.session.reserve(size) {
+		buf.mx.Unlock()
+		buf.pool.Put(frame[:maxFrameLen])
+		return ErrFlowControlViolation
+	}
+	if buf.closed {
+		discard := buf.discard
+		if discard {
+			buf.sessionHeld += size
+		}
+		buf.mx.Unlock()
+		buf.pool.Put(frame[:maxFrameLen])
+		if discard {
+			buf.acknowledge(size)
+		} else if buf.session != nil {
+			buf.session.release(size)
+		}
+		return nil
+	}
+	if buf.outstanding+size > buf.window {
+		buf.mx.Unlock()
+		buf.pool.Put(frame[:maxFrameLen])
+		return ErrFlowControlViolation
+	}
+	buf.outstanding += size
+	buf.sessionHeld += size
+	coalesced := false
+	if buf.flowControl == byteFlowControl && len(buf.queue) > 0 {
+		// Copy small frames into the tail of the queue if there's room
+		last := buf.queue[len(buf.queue)-1]
+		if MaxDataLen-len(last) >= len(frame) {
+			buf.queue[len(buf.queue)-1] = append(last, frame...)
+			coalesced = true
+		}
+	}
+	if !coalesced {
+		buf.queue = append(buf.queue, frame)
+	}
+	buf.mx.Unlock()
+	if coalesced {
+		buf.pool.Put(frame[:maxFrameLen])
 	}
-	buf.in <- frame
-	buf.mx.RUnlock()
+	buf.notify()
+	return nil
 }
 
 // reads available data into the given buffer. If no data is queued, read will
@@ -60,10 +145,13 @@ func (buf *receiveBuffer) submit(frame []byte) {
 // As long as some data was already queued, read will not wait for more data
 // even if b has not yet been filled.
 func (buf *receiveBuffer) read(b []byte, deadline time.Time) (totalN int, err error) {
+	buf.startReading()
+	defer buf.doneReading()
 	for {
 		n := copy(b, buf.current)
 		buf.current = buf.current[n:]
 		totalN += n
+		buf.onConsumed(n)
 		if n == len(b) {
 			// nothing more to copy
 			return
@@ -72,54 +160,169 @@ func (buf *receiveBuffer) read(b []byte, deadline time.Time) (totalN int, err er
 		// b can hold more than we had in the current slice, try to read more if
 		// immediately available.
 		b = b[n:]
-		select {
-		case frame, open := <-buf.in:
+		frame, closed := buf.dequeue()
+		if frame != nil {
 			// Read next frame, continue loop
-			if !open && frame == nil {
-				// we've hit the end
-				err = io.EOF
-				return
-			}
 			buf.onFrame(frame)
 			continue
-		default:
-			// nothing immediately available
-			if totalN > 0 {
-				// we've read something, return what we have
-				return
-			}
+		}
+		if closed {
+			// we've hit the end
+			err = io.EOF
+			return
+		}
+		if totalN > 0 {
+			// we've read something, return what we have
+			return
+		}
 
-			// We haven't ready anything, wait up till deadline to read
-			now := time.Now()
-			if deadline.IsZero() {
-				// Default deadline to something really large so that we effectively
-				// don't time out.
-				deadline = largeDeadline
-			} else if deadline.Before(now) {
-				// Deadline already past, don't bother doing anything
-				err = ErrTimeout
-				return
-			}
-			timer := time.NewTimer(deadline.Sub(now))
-			select {
-			case <-timer.C:
-				// Nothing read within deadline
-				err = ErrTimeout
-				timer.Stop()
+		// We haven't read anything, wait up till deadline to read
+		err = buf.wait(deadline)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeTo writes data to w as it becomes available, straight out of the queued
+// frames, until the buffer is closed and everything has been written or w
+// returns an error. Whenever no data is queued, writeTo waits up to the
+// deadline returned by deadline to receive some data.
+func (buf *receiveBuffer) writeTo(w io.Writer, deadline func() time.Time) (totalN int64, err error) {
+	buf.startReading()
+	defer buf.doneReading()
+	for {
+		if len(buf.current) > 0 {
+			n, writeErr := w.Write(buf.current)
+			buf.current = buf.current[n:]
+			totalN += int64(n)
+			buf.onConsumed(n)
+			if writeErr != nil {
+				err = writeErr
 				return
-			case frame, open := <-buf.in:
-				// Read next frame, continue loop
-				timer.Stop()
-				if !open && frame == nil {
-					// we've hit the end
-					err = io.EOF
-					return
-				}
-				buf.onFrame(frame)
-				continue
 			}
+			continue
+		}
+
+		frame, closed := buf.dequeue()
+		if frame != nil {
+			buf.onFrame(frame)
+			continue
+		}
+		if closed {
+			// we've hit the end
+			return
+		}
+
+		err = buf.wait(deadline())
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readFrame returns the next available data in a pooled buffer, handing over
+// queued frames as is rather than copying them. Like read, it waits up to
+// deadline if no data is available.
+func (buf *receiveBuffer) readFrame(deadline time.Time) ([]byte, error) {
+	buf.startReading()
+	defer buf.doneReading()
+	for {
+		if len(buf.current) > 0 {
+			// Left over from a previous read, copy it into its own buffer
+			frame := buf.pool.Get()[:len(buf.current)]
+			copy(frame, buf.current)
+			buf.current = nil
+			buf.onConsumed(len(frame))
+			return frame, nil
 		}
+
+		frame, closed := buf.dequeue()
+		if frame != nil {
+			// Hand the whole frame over instead of holding on to it
+			buf.onFrame(frame)
+			buf.poolable = nil
+			buf.current = nil
+			buf.onConsumed(len(frame))
+			return frame, nil
+		}
+		if closed {
+			return nil, io.EOF
+		}
+
+		err := buf.wait(deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// startReading records that a read is in progress, during which only the
+// reader touches poolable and current.
+func (buf *receiveBuffer) startReading() {
+	buf.mx.Lock()
+	buf.reading = true
+	buf.mx.Unlock()
+}
+
+// doneReading records that a read has finished. If the buffer was drained in
+// the meantime, this returns the frame that the reader was holding on to to the
+// pool.
+func (buf *receiveBuffer) doneReading() {
+	buf.mx.Lock()
+	buf.reading = false
+	if buf.drained {
+		buf.releasePoolable()
 	}
+	buf.mx.Unlock()
+}
+
+// releasePoolable returns the frame that's currently being read to the pool.
+// Must be called with mx held and no read in progress.
+func (buf *receiveBuffer) releasePoolable() {
+	if buf.poolable != nil {
+		buf.pool.Put(buf.poolable[:maxFrameLen])
+		buf.poolable = nil
+	}
+	buf.current = nil
+}
+
+// wait waits up till deadline for something to change, returning ErrTimeout if
+// nothing did. If deadline is Zero, wait waits indefinitely.
+func (buf *receiveBuffer) wait(deadline time.Time) error {
+	now := time.Now()
+	if deadline.IsZero() {
+		// Default deadline to something really large so that we effectively
+		// don't time out.
+		deadline = largeDeadline
+	} else if deadline.Before(now) {
+		// Deadline already past, don't bother doing anything
+		return ErrTimeout
+	}
+	timer := time.NewTimer(deadline.Sub(now))
+	select {
+	case <-timer.C:
+		// Nothing changed within deadline
+		return ErrTimeout
+	case <-buf.avail:
+		// Something changed
+		timer.Stop()
+		return nil
+	}
+}
+
+// dequeue removes the next frame from the queue, if there is one, and also
+// indicates whether the buffer has been closed.
+func (buf *receiveBuffer) dequeue() ([]byte, bool) {
+	buf.mx.Lock()
+	defer buf.mx.Unlock()
+	if len(buf.queue) == 0 {
+		return nil, buf.closed
+	}
+	frame := buf.queue[0]
+	buf.queue[0] = nil
+	buf.queue = buf.queue[1:]
+	return frame, buf.closed
 }
 
 func (buf *receiveBuffer) onFrame(frame []byte) {
@@ -128,16 +331,176 @@ func (buf *receiveBuffer) onFrame(frame []byte) {
 		buf.pool.Put(buf.poolable[:maxFrameLen])
 	}
 	buf.poolable = frame
-	buf.current = frame[frameHeaderLen:]
-	// immediately acknowledge that we've queued a frame
-	buf.ack <- buf.ackFrame
+	buf.current = frame
+	if buf.flowControl == frameFlowControl {
+		// immediately acknowledge that we've queued a frame
+		buf.sendACK()
+	}
+}
+
+// onConsumed records that the application has read n bytes and sends a window
+// update once enough bytes have been consumed.
+func (buf *receiveBuffer) onConsumed(n int) {
+	if buf.flowControl != byteFlowControl || n == 0 {
+		return
+	}
+	buf.mx.Lock()
+	buf.unacked += n
+	buf.sampled += n
+	increment := 0
+	if buf.unacked >= buf.window/2 {
+		increment = buf.unacked + buf.tuneWindow()
+		buf.outstanding -= buf.unacked
+		buf.unacked = 0
+	}
+	// Don't release more than we hold in case drain() already released it
+	release := n
+	if release > buf.sessionHeld {
+		release = buf.sessionHeld
+	}
+	buf.sessionHeld -= release
+	buf.mx.Unlock()
+	if increment > 0 {
+		buf.sendWindowUpdate(increment)
+	}
+	if buf.session != nil {
+		buf.session.release(release)
+	}
+}
+
+// tuneWindow adjusts the window based on how quickly the application has been
+// consuming data and returns by how much it changed. The window can only shrink
+// by as much as we're about to grant, since we can't take back credit that the
+// sender already has. Must be called with mx held.
+func (buf *receiveBuffer) tuneWindow() int {
+	if buf.tuning == nil {
+		return 0
+	}
+	now := time.Now()
+	target := buf.tuning.targetWindow(buf.sampled, now.Sub(buf.sampleStart))
+	if target == 0 {
+		// Keep sampling
+		return 0
+	}
+	buf.sampleStart = now
+	buf.sampled = 0
+	if target < buf.window-buf.unacked {
+		target = buf.window - buf.unacked
+	}
+	delta := target - buf.window
+	buf.window = target
+	return delta
+}
+
+// acknowledge grants credit for a frame of the given size without it having
+// been read by the application.
+func (buf *receiveBuffer) acknowledge(size int) {
+	if buf.flowControl == byteFlowControl {
+		buf.onConsumed(size)
+		return
+	}
+	buf.sendACK()
+}
+
+func (buf *receiveBuffer) sendACK() {
+	buf.mx.Lock()
+	buf.outstanding--
+	buf.mx.Unlock()
+	buf.send(buf.ackFrame)
+}
+
+func (buf *receiveBuffer) sendWindowUpdate(increment int) {
+	frame := make([]byte, windowUpdateLen+len(buf.streamID))
+	binaryEncoding.PutUint32(frame, uint32(increment))
+	copy(frame[windowUpdateLen:], buf.streamID)
+	setFrameType(frame[windowUpdateLen:], frameTypeWindowUpdate)
+	buf.send(frame)
+}
+
+// send queues a control frame for the session to send, unless the session
+// has closed and won't be sending anything anymore.
+func (buf *receiveBuffer) send(frame []byte) {
+	select {
+	case buf.ack <- frame:
+		// okay
+	case <-buf.closeCh:
+		// session closed, nobody to tell
+	}
+}
+
+// pendingACKs returns how much of the window is taken up by data that we
+// haven't acknowledged yet.
+func (buf *receiveBuffer) pendingACKs() int {
+	buf.mx.Lock()
+	defer buf.mx.Unlock()
+	return buf.outstanding
+}
+
+// sizeOf calculates how much of the window the given frame takes up.
+func (buf *receiveBuffer) sizeOf(frame []byte) int {
+	if buf.flowControl == byteFlowControl {
+		return len(frame)
+	}
+	return 1
+}
+
+func (buf *receiveBuffer) notify() {
+	select {
+	case buf.avail <- struct{}{}:
+		// notified
+	default:
+		// notification already pending
+	}
 }
 
 func (buf *receiveBuffer) close() {
 	buf.mx.Lock()
-	if !buf.closed {
-		buf.closed = true
-		close(buf.in)
+	buf.closed = true
+	buf.mx.Unlock()
+	buf.notify()
+}
+
+// closeRead closes the receiveBuffer and discards any queued or subsequently
+// submitted frames, acknowledging them so that the sender can keep sending.
+func (buf *receiveBuffer) closeRead() {
+	buf.mx.Lock()
+	buf.closed = true
+	buf.discard = true
+	queue := buf.queue
+	buf.queue = nil
+	buf.mx.Unlock()
+	buf.notify()
+
+	for _, frame := range queue {
+		size := buf.sizeOf(frame)
+		buf.pool.Put(frame[:maxFrameLen])
+		buf.acknowledge(size)
 	}
+}
+
+// drain closes the receiveBuffer and discards anything that's still buffered,
+// since nobody is going to read it anymore. This gives the buffered data's
+// share of the session window back to the sender and returns the buffered
+// frames to the pool, including the one that's currently being read (once the
+// read in progress, if any, is done with it).
+func (buf *receiveBuffer) drain() {
+	buf.mx.Lock()
+	buf.closed = true
+	buf.drained = true
+	if !buf.reading {
+		buf.releasePoolable()
+	}
+	queue := buf.queue
+	buf.queue = nil
+	held := buf.sessionHeld
+	buf.sessionHeld = 0
 	buf.mx.Unlock()
+	buf.notify()
+
+	for _, frame := range queue {
+		buf.pool.Put(frame[:maxFrameLen])
+	}
+	if buf.session != nil {
+		buf.session.release(held)
+	}
 }
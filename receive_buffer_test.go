@@ -2,6 +2,7 @@ package connmux
 
 import (
 	"fmt"
+	"io"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -17,11 +18,11 @@ func TestReceiveBuffer(t *testing.T) {
 
 	pool := &testpool{}
 	ack := make(chan []byte, 1000)
-	buf := newReceiveBuffer(id, ack, pool, depth)
+	buf := newReceiveBuffer(id, ack, make(chan struct{}), pool, depth, frameFlowControl, nil, nil)
 	for i := 0; i < 2; i++ {
 		b := pool.Get()
-		b[frameHeaderLen] = fmt.Sprint(i)[0]
-		buf.submit(b[:frameHeaderLen+1])
+		b[0] = fmt.Sprint(i)[0]
+		buf.submit(b[:1])
 	}
 
 	b := make([]byte, 2)
@@ -53,6 +54,174 @@ ackloop:
 	assert.Equal(t, 2, totalAcks)
 }
 
+func TestReceiveBufferByteFlowControl(t *testing.T) {
+	id := make([]byte, idLen)
+	binaryEncoding.PutUint32(id, 27)
+
+	depth := 2
+	window := depth * MaxDataLen
+
+	pool := &testpool{}
+	ack := make(chan []byte, 1000)
+	buf := newReceiveBuffer(id, ack, make(chan struct{}), pool, depth, byteFlowControl, nil, nil)
+
+	// Lots of small frames should get coalesced
+	for i := 0; i < 100; i++ {
+		b := pool.Get()
+		b[0] = fmt.Sprint(i % 10)[0]
+		if !assert.NoError(t, buf.submit(b[:1])) {
+			return
+		}
+	}
+	assert.Equal(t, 99*maxFrameLen, pool.getTotalReturned(), "Small frames should have been coalesced and returned to pool")
+
+	b := make([]byte, 100)
+	n, err := buf.read(b, time.Time{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 100, n)
+	assert.Equal(t, "0123456789", string(b[:10]))
+	select {
+	case <-ack:
+		assert.Fail(t, "Shouldn't have sent window update before consuming half of window")
+	default:
+		// good
+	}
+
+	// Fill up to the window
+	for i := 0; i < depth; i++ {
+		b := pool.Get()
+		max := MaxDataLen
+		if i == 0 {
+			max -= 100
+		}
+		if !assert.NoError(t, buf.submit(b[:max])) {
+			return
+		}
+	}
+	b = pool.Get()
+	assert.Equal(t, ErrFlowControlViolation, buf.submit(b[:1]), "Submitting past window should have failed")
+
+	b = make([]byte, window)
+	n, err = io.ReadFull(&bufReader{buf}, b[:window-100])
+	if !assert.NoError(t, err) {
+		return
+	}
+	totalIncrement := 0
+ackloop:
+	for {
+		select {
+		case a := <-ack:
+			if assert.EqualValues(t, frameTypeWindowUpdate, a[windowUpdateLen]) {
+				totalIncrement += int(binaryEncoding.Uint32(a))
+			}
+		default:
+			break ackloop
+		}
+	}
+	assert.Equal(t, window, totalIncrement, "Should have granted credit for everything that was read")
+}
+
+func TestReceiveBufferSessionWindow(t *testing.T) {
+	id1 := make([]byte, idLen)
+	binaryEncoding.PutUint32(id1, 27)
+	id2 := make([]byte, idLen)
+	binaryEncoding.PutUint32(id2, 28)
+
+	pool := &testpool{}
+	ack := make(chan []byte, 1000)
+	session := newSessionWindow(minByteWindow, ack, make(chan struct{}))
+	buf1 := newReceiveBuffer(id1, ack, make(chan struct{}), pool, 4, byteFlowControl, session, nil)
+	buf2 := newReceiveBuffer(id2, ack, make(chan struct{}), pool, 4, byteFlowControl, session, nil)
+
+	b := pool.Get()
+	if !assert.NoError(t, buf1.submit(b)) {
+		return
+	}
+	b = pool.Get()
+	if !assert.NoError(t, buf2.submit(b)) {
+		return
+	}
+	b = pool.Get()
+	assert.Equal(t, ErrFlowControlViolation, buf1.submit(b[:1]), "Submitting past session window should have failed even though stream window has room")
+
+	// Closing a stream without reading should give back its share of the window
+	buf1.drain()
+	sessionIncrement := 0
+ackloop:
+	for {
+		select {
+		case a := <-ack:
+			if assert.EqualValues(t, frameTypeWindowUpdate, a[windowUpdateLen]) {
+				a[windowUpdateLen] = 0
+				if assert.EqualValues(t, 0, binaryEncoding.Uint32(a[windowUpdateLen:]), "Should only have sent session-level window update") {
+					sessionIncrement += int(binaryEncoding.Uint32(a))
+				}
+			}
+		default:
+			break ackloop
+		}
+	}
+	assert.Equal(t, MaxDataLen, sessionIncrement, "Should have released drained data")
+
+	b = pool.Get()
+	assert.NoError(t, buf2.submit(b), "Submitting should succeed once window has been released")
+}
+
+func TestReceiveBufferAutoTuning(t *testing.T) {
+	id := make([]byte, idLen)
+	binaryEncoding.PutUint32(id, 27)
+
+	rtt := 50 * time.Millisecond
+	pool := &testpool{}
+	ack := make(chan []byte, 1000)
+	tuning := newAutoTuning(2, 8, func() time.Duration { return rtt })
+	buf := newReceiveBuffer(id, ack, make(chan struct{}), pool, 2, byteFlowControl, nil, tuning)
+
+	readAndGetIncrement := func(frames int) int {
+		for i := 0; i < frames; i++ {
+			if !assert.NoError(t, buf.submit(pool.Get())) {
+				return -1
+			}
+		}
+		b := make([]byte, frames*MaxDataLen)
+		_, err := io.ReadFull(&bufReader{buf}, b)
+		if !assert.NoError(t, err) {
+			return -1
+		}
+		select {
+		case a := <-ack:
+			return int(binaryEncoding.Uint32(a))
+		default:
+			return 0
+		}
+	}
+
+	// Pretend that the application consumed a lot in the last round trip
+	buf.sampleStart = time.Now().Add(-1 * rtt)
+	buf.sampled = 4 * MaxDataLen
+	assert.Equal(t, 7*MaxDataLen, readAndGetIncrement(1), "Window should have grown to maximum")
+	assert.Equal(t, 8*MaxDataLen, buf.window)
+
+	// Pretend that the application has been consuming very slowly
+	buf.sampleStart = time.Now().Add(-10 * time.Second)
+	assert.Equal(t, 0, readAndGetIncrement(4), "Window should have shrunk by as much as was consumed")
+	assert.Equal(t, 4*MaxDataLen, buf.window)
+	buf.sampleStart = time.Now().Add(-10 * time.Second)
+	assert.Equal(t, 0, readAndGetIncrement(2), "Window should have shrunk by as much as was consumed")
+	assert.Equal(t, 2*MaxDataLen, buf.window, "Window should have shrunk to minimum")
+}
+
+// bufReader adapts a receiveBuffer to io.Reader
+type bufReader struct {
+	buf *receiveBuffer
+}
+
+func (r *bufReader) Read(b []byte) (int, error) {
+	return r.buf.read(b, time.Time{})
+}
+
 type testpool struct {
 	totalReturned int64
 }
@@ -69,6 +238,10 @@ func (tp *testpool) Put(b []byte) {
 	atomic.AddInt64(&tp.totalReturned, int64(len(b)))
 }
 
+func (tp *testpool) Stats() BufferPoolStats {
+	return BufferPoolStats{}
+}
+
 func (tp *testpool) getTotalReturned() int {
 	return int(atomic.LoadInt64(&tp.totalReturned))
 }
@@ -0,0 +1,52 @@
+package connmux
+
+import (
+	"fmt"
+)
+
+// RefuseCode tells a dialer why the other end refused to open a stream (see
+// Config.StreamFilter). Codes other than the ones defined here can be used to
+// convey application-specific reasons.
+type RefuseCode uint32
+
+const (
+	// RefuseNone means that the stream is accepted.
+	RefuseNone RefuseCode = 0
+
+	// RefuseUnspecified means that the stream was refused without giving a
+	// specific reason.
+	RefuseUnspecified RefuseCode = 1
+
+	// RefuseNotAccepting means that the other end doesn't accept streams at
+	// all.
+	RefuseNotAccepting RefuseCode = 2
+
+	// RefuseOverloaded means that the other end is too busy to handle more
+	// streams right now.
+	RefuseOverloaded RefuseCode = 3
+)
+
+func (code RefuseCode) String() string {
+	switch code {
+	case RefuseNone:
+		return "none"
+	case RefuseUnspecified:
+		return "unspecified"
+	case RefuseNotAccepting:
+		return "not accepting"
+	case RefuseOverloaded:
+		return "overloaded"
+	default:
+		return fmt.Sprintf("code %d", uint32(code))
+	}
+}
+
+// StreamRefusedError is returned when dialing a stream that the other end
+// refused to open.
+type StreamRefusedError struct {
+	Code RefuseCode
+}
+
+func (e *StreamRefusedError) Error() string {
+	return fmt.Sprintf("stream refused by peer: %v", e.Code)
+}
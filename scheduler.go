@@ -0,0 +1,196 @@
+package connmux
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// scales the cost of frames so that dividing by priority doesn't lose too
+	// much precision
+	priorityScale = 1 << 16
+)
+
+// scheduler decides which frame a session sends next. Control frames (acks,
+// window updates, pings, etc.) always go first. Streams' frames are scheduled
+// with weighted fair queuing, so streams that have data to send share the
+// connection in proportion to their priorities and a stream with lots of data
+// can't starve the others. A stream's own frames (including its FIN and RST)
+// are always sent in the order in which they were queued. How many frames a
+// stream can queue is bounded by its flow control window.
+//
+// Fairness is tracked with a virtual clock. Each data frame gets a virtual
+// finish time that's later than the stream's previous frame by the size of the
+// frame divided by the stream's priority, and the frame with the earliest
+// finish time is sent first. Streams that haven't sent anything in a while
+// start again at the current virtual time so that they can't save up credit
+// for later.
+type scheduler struct {
+	control chan []byte
+	ready   chan struct{}
+	pending pendingFrames
+	vtime   uint64
+	seq     uint64
+	closed  bool
+	mx      sync.Mutex
+}
+
+func newScheduler(control chan []byte) *scheduler {
+	return &scheduler{
+		control: control,
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// streamQueue is a stream's place in the scheduler.
+type streamQueue struct {
+	priority int32 // accessed atomically
+	sched    *scheduler
+	finish   uint64
+}
+
+func (s *scheduler) newQueue(priority int) *streamQueue {
+	q := &streamQueue{sched: s}
+	q.setPriority(priority)
+	return q
+}
+
+func (q *streamQueue) setPriority(priority int) {
+	if priority < 1 {
+		priority = 1
+	}
+	atomic.StoreInt32(&q.priority, int32(priority))
+}
+
+func (q *streamQueue) getPriority() int {
+	return int(atomic.LoadInt32(&q.priority))
+}
+
+// send queues one of the stream's frames for sending. It returns false if the
+// scheduler has been closed, in which case the frame will never be sent.
+func (q *streamQueue) send(frame []byte) bool {
+	s := q.sched
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return false
+	}
+	start := q.finish
+	if start < s.vtime {
+		start = s.vtime
+	}
+	// Since frames always cost something, the stream's frames finish in the
+	// order in which they're queued
+	q.finish = start + 1 + uint64(len(frame))*priorityScale/uint64(q.getPriority())
+	heap.Push(&s.pending, &pendingFrame{
+		frame:  frame,
+		finish: q.finish,
+		seq:    s.seq,
+	})
+	s.seq++
+	s.mx.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+		// notified
+	default:
+		// notification already pending
+	}
+	return true
+}
+
+// next waits for the next frame to send.
+func (s *scheduler) next() []byte {
+	for {
+		if frame := s.tryNext(); frame != nil {
+			return frame
+		}
+		select {
+		case frame := <-s.control:
+			return frame
+		case <-s.ready:
+			// try again
+		}
+	}
+}
+
+// tryNext returns the next frame to send if one is available right away, or
+// nil if there isn't.
+func (s *scheduler) tryNext() []byte {
+	select {
+	case frame := <-s.control:
+		return frame
+	default:
+		// no control frames waiting
+	}
+	return s.dequeue()
+}
+
+// dequeue takes the data frame with the earliest finish time, if there is one.
+func (s *scheduler) dequeue() []byte {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	p := heap.Pop(&s.pending).(*pendingFrame)
+	s.vtime = p.finish
+	return p.frame
+}
+
+// close stops the scheduler from taking any more of the streams' frames and
+// returns the ones that were still waiting to be sent.
+func (s *scheduler) close() [][]byte {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.closed = true
+	frames := make([][]byte, 0, len(s.pending))
+	for _, p := range s.pending {
+		frames = append(frames, p.frame)
+	}
+	s.pending = nil
+	return frames
+}
+
+// numPending returns the number of data frames waiting to be sent.
+func (s *scheduler) numPending() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.pending)
+}
+
+type pendingFrame struct {
+	frame  []byte
+	finish uint64
+	seq    uint64
+}
+
+// pendingFrames implements heap.Interface, ordering frames by finish time and
+// then by the order in which they were queued.
+type pendingFrames []*pendingFrame
+
+func (pf pendingFrames) Len() int { return len(pf) }
+
+func (pf pendingFrames) Less(i, j int) bool {
+	if pf[i].finish != pf[j].finish {
+		return pf[i].finish < pf[j].finish
+	}
+	return pf[i].seq < pf[j].seq
+}
+
+func (pf pendingFrames) Swap(i, j int) {
+	pf[i], pf[j] = pf[j], pf[i]
+}
+
+func (pf *pendingFrames) Push(x interface{}) {
+	*pf = append(*pf, x.(*pendingFrame))
+}
+
+func (pf *pendingFrames) Pop() interface{} {
+	old := *pf
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*pf = old[:len(old)-1]
+	return p
+}
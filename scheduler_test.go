@@ -0,0 +1,35 @@
+package connmux
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	control := make(chan []byte, 1)
+	sched := newScheduler(control)
+
+	low := sched.newQueue(1)
+	high := sched.newQueue(3)
+	for i := 0; i < 40; i++ {
+		for _, q := range []*streamQueue{low, high} {
+			frame := make([]byte, 100)
+			frame[0] = byte(q.getPriority())
+			frame[1] = byte(i)
+			q.send(frame)
+		}
+	}
+
+	control <- []byte("control")
+	assert.Equal(t, "control", string(sched.next()), "Control frames should go first")
+
+	counts := make(map[byte]int)
+	for i := 0; i < 40; i++ {
+		frame := sched.next()
+		assert.Equal(t, counts[frame[0]], int(frame[1]), "Stream's frames should be sent in order")
+		counts[frame[0]]++
+	}
+	assert.Equal(t, 10, counts[1], "Low priority stream should have gotten a quarter of the frames")
+	assert.Equal(t, 30, counts[3], "High priority stream should have gotten three quarters of the frames")
+}
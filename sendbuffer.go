@@ -1,105 +1,296 @@
 package connmux
 
 import (
+	"sync/atomic"
 	"time"
 )
 
-var (
-	closeTimeout = 30 * time.Second
-)
-
 // sendBuffer buffers outgoing frames. It holds up to <windowSize> frames,
 // after which it starts back-pressuring.
 //
-// It sends an initial <windowSize> frames. After that, in order to avoid
-// filling the receiver's receiveBuffer, it waits for ACKs from the receiver
-// before sending new frames.
+// It sends frames for as long as it has credit. After that, in order to avoid
+// filling the receiver's receiveBuffer, it waits for the receiver to grant more
+// credit before sending new frames. With frameFlowControl, the initial credit
+// is <windowSize> frames and each ACK from the receiver grants one more frame.
+// With byteFlowControl, the initial credit is <windowSize> maximum-sized frames
+// worth of bytes and window updates from the receiver grant more bytes. With
+// byteFlowControl, every frame also needs credit from the session-level window
+// that's shared by all of the session's streams. Once it has credit, it hands
+// the frame to the session's scheduler, which decides when it gets sent
+// relative to other streams' frames.
 //
 // When closed normally it sends an RST frame to the receiver to indicate that
 // the connection is closed. We handle this from sendBuffer so that we can
-// ensure buffered frames are sent before sending the RST.
+// ensure buffered frames are sent before sending the RST. With closeCodes, the
+// RST also tells the receiver why the stream was closed (see CloseCode).
+//
+// When only the write side is closed, it sends a FIN frame after all buffered
+// frames have been sent and then waits for the stream to be closed fully.
 type sendBuffer struct {
+	buffered       int64 // bytes written but not yet sent, accessed atomically
+	queued         int64 // frames written but not yet sent, accessed atomically
+	awaitingACK    int64 // unix nanos of first frame sent since last ACK, accessed atomically
+	sent           activity
 	streamID       []byte
+	queue          *streamQueue
+	pool           BufferPool
 	in             chan []byte
-	ack            chan bool
-	closeRequested chan bool
+	flowControl    flowControl
+	credit         *credit
+	sessionCredit  *credit
+	closeTimeout   time.Duration
+	closeCodes     bool
+	closeRequested chan closeRequest
+	finRequested   chan bool
+	done           chan struct{}
 }
 
-func newSendBuffer(streamID []byte, out chan []byte, windowSize int) *sendBuffer {
+// closeRequest asks a sendBuffer to close, optionally sending an RST with the
+// given code and reason once everything buffered has been sent.
+type closeRequest struct {
+	sendRST bool
+	code    CloseCode
+	reason  string
+}
+
+func newSendBuffer(streamID []byte, queue *streamQueue, pool BufferPool, windowSize int, fc flowControl, sessionCredit *credit, closeTimeout time.Duration, closeCodes bool) *sendBuffer {
+	initialCredit := windowSize
+	if fc == byteFlowControl {
+		initialCredit = byteWindow(windowSize)
+	}
 	buf := &sendBuffer{
 		streamID:       streamID,
+		queue:          queue,
+		pool:           pool,
 		in:             make(chan []byte, windowSize),
-		ack:            make(chan bool, windowSize),
-		closeRequested: make(chan bool, 1),
-	}
-	// Write initial acks to send up to windowSize right away
-	for i := 0; i < windowSize; i++ {
-		buf.ack <- true
+		flowControl:    fc,
+		credit:         newCredit(initialCredit),
+		sessionCredit:  sessionCredit,
+		closeTimeout:   closeTimeout,
+		closeCodes:     closeCodes,
+		closeRequested: make(chan closeRequest, 1),
+		finRequested:   make(chan bool, 1),
+		done:           make(chan struct{}),
 	}
-	go buf.sendLoop(out)
+	go buf.sendLoop()
 	return buf
 }
 
-func (buf *sendBuffer) sendLoop(out chan []byte) {
-	sendRST := false
+func (buf *sendBuffer) sendLoop() {
+	var rst closeRequest
+	sendFIN := false
+	closeRequested := false
+	timedOut := false
+	var frame []byte
 
 	defer func() {
-		if sendRST {
-			buf.sendRST(out)
+		if frame != nil {
+			// Gave up on sending this one
+			buf.drop(frame)
+		}
+		if sendFIN {
+			buf.sendControl(frameTypeFIN)
+		}
+		if !closeRequested {
+			// Only the write side was closed, wait for the stream to close fully
+			rst = <-buf.closeRequested
+		}
+		if rst.sendRST {
+			if timedOut {
+				// Let the other end know that it didn't get everything
+				rst.code = CloseTimeout
+				rst.reason = ""
+			}
+			buf.sendRST(rst.code, rst.reason)
 		}
 
 		// drain remaining writes
-		for range buf.in {
+		for frame := range buf.in {
+			buf.drop(frame)
 		}
+		close(buf.done)
 	}()
 
+	closing := false
 	closeTimer := time.NewTimer(largeTimeout)
 	signalClose := func() {
-		close(buf.in)
-		closeTimer.Reset(closeTimeout)
+		if !closing {
+			closing = true
+			close(buf.in)
+			closeTimer.Reset(buf.closeTimeout)
+		}
+	}
+	onCloseRequested := func(req closeRequest) {
+		closeRequested = true
+		rst = req
+		signalClose()
+	}
+	onFINRequested := func() {
+		sendFIN = true
+		signalClose()
 	}
 
-	// Send one frame for every ack
+	// Send frames as long as we have credit
 	for {
+		// Find out about new credit that arrives after we've tried taking some
+		creditChanged := buf.credit.changes()
+		sessionCreditChanged := buf.sessionCredit.changes()
+		if frame != nil && buf.takeCredit(buf.costOf(frame)) {
+			buf.onSent(frame)
+			buf.sent.record(len(frame))
+			atomic.CompareAndSwapInt64(&buf.awaitingACK, 0, time.Now().UnixNano())
+			if !buf.queue.send(append(frame, buf.streamID...)) {
+				// Session is done sending
+				buf.pool.Put(frame[:maxFrameLen])
+			}
+			frame = nil
+			continue
+		}
+
+		// Only grab the next frame once we have some credit (or are closing, in
+		// which case we need to find out when we've sent everything)
+		var in chan []byte
+		if frame == nil && (closing || buf.credit.hasSome()) {
+			in = buf.in
+		}
+
 		select {
-		case <-buf.ack:
-			// Grab next frame
-			select {
-			case frame, open := <-buf.in:
-				if frame != nil {
-					out <- append(frame, buf.streamID...)
-				}
-				if !open {
-					// We've closed
-					return
-				}
-			case sendRST = <-buf.closeRequested:
-				signalClose()
+		case next, open := <-in:
+			if !open {
+				// We've closed and sent everything
+				return
 			}
-		case sendRST = <-buf.closeRequested:
+			frame = next
+		case <-creditChanged:
+			// Got more credit, try again
+		case <-sessionCreditChanged:
+			// Got more session-level credit, try again
+		case req := <-buf.closeRequested:
 			// Signal that we're closing
-			signalClose()
+			onCloseRequested(req)
+		case <-buf.finRequested:
+			// Signal that we're done writing
+			onFINRequested()
 		case <-closeTimer.C:
-			// We had queued writes, but we haven't gotten any acks within
-			// closeTimeout of closing, don't wait any longer
+			// We had queued writes, but we haven't gotten any credit within
+			// closeTimeout of closing, don't wait any longer. Since not everything
+			// got sent, don't send a FIN either.
+			sendFIN = false
+			timedOut = true
 			return
 		}
 	}
 }
 
+// takeCredit takes the given amount of credit from both the stream and the
+// session, if available.
+func (buf *sendBuffer) takeCredit(cost int) bool {
+	if !buf.credit.take(cost) {
+		return false
+	}
+	if buf.sessionCredit != nil && !buf.sessionCredit.take(cost) {
+		// Nobody else uses the stream's credit, so no need to notify anyone
+		buf.credit.refund(cost)
+		return false
+	}
+	return true
+}
+
+// onACK grants the credit that the receiver acknowledged and returns how long
+// we waited for the acknowledgement since first sending something after the
+// previous one, or 0 if we weren't waiting.
+func (buf *sendBuffer) onACK(credit int) time.Duration {
+	buf.credit.add(credit)
+	since := atomic.SwapInt64(&buf.awaitingACK, 0)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// onWrite records that the given frame has been written to the sendBuffer.
+func (buf *sendBuffer) onWrite(frame []byte) {
+	atomic.AddInt64(&buf.buffered, int64(len(frame)))
+	atomic.AddInt64(&buf.queued, 1)
+}
+
+// onSent records that the given frame has left the sendBuffer, either because
+// it was handed to the session for sending or because it was dropped.
+func (buf *sendBuffer) onSent(frame []byte) {
+	atomic.AddInt64(&buf.buffered, -int64(len(frame)))
+	atomic.AddInt64(&buf.queued, -1)
+}
+
+// drop records that the given frame won't be sent and returns it to the pool.
+func (buf *sendBuffer) drop(frame []byte) {
+	buf.onSent(frame)
+	buf.pool.Put(frame[:maxFrameLen])
+}
+
+// bufferedBytes returns the number of bytes that have been written to the
+// sendBuffer but not yet sent.
+func (buf *sendBuffer) bufferedBytes() int {
+	return int(atomic.LoadInt64(&buf.buffered))
+}
+
+// queuedFrames returns the number of frames that have been written to the
+// sendBuffer but not yet sent.
+func (buf *sendBuffer) queuedFrames() int {
+	return int(atomic.LoadInt64(&buf.queued))
+}
+
+// costOf calculates how much credit it takes to send the given frame.
+func (buf *sendBuffer) costOf(frame []byte) int {
+	if buf.flowControl == byteFlowControl {
+		return len(frame)
+	}
+	return 1
+}
+
 func (buf *sendBuffer) close(sendRST bool) {
+	buf.requestClose(closeRequest{sendRST: sendRST})
+}
+
+func (buf *sendBuffer) requestClose(req closeRequest) {
 	select {
-	case buf.closeRequested <- sendRST:
+	case buf.closeRequested <- req:
 		// okay
 	default:
 		// close already requested, ignore
 	}
 }
 
-func (buf *sendBuffer) sendRST(out chan []byte) {
-	// Send an RST frame with the streamID
-	rst := make([]byte, len(buf.streamID))
-	copy(rst, buf.streamID)
-	setFrameType(rst, frameTypeRST)
-	out <- rst
+func (buf *sendBuffer) closeWrite() {
+	select {
+	case buf.finRequested <- true:
+		// okay
+	default:
+		// closeWrite already requested, ignore
+	}
+}
+
+func (buf *sendBuffer) sendControl(frameType byte) {
+	// Send a control frame (e.g. RST or FIN) with the streamID
+	frame := make([]byte, len(buf.streamID))
+	copy(frame, buf.streamID)
+	setFrameType(frame, frameType)
+	buf.queue.send(frame)
+}
+
+// sendRST sends an RST frame with the streamID. With closeCodes, the frame
+// also carries the given code and reason.
+func (buf *sendBuffer) sendRST(code CloseCode, reason string) {
+	if !buf.closeCodes {
+		buf.sendControl(frameTypeRST)
+		return
+	}
+	reason = truncateCloseReason(reason)
+	payloadLen := rstHeaderLen + len(reason)
+	frame := make([]byte, payloadLen+len(buf.streamID))
+	binaryEncoding.PutUint32(frame, uint32(code))
+	frame[closeCodeLen] = byte(len(reason))
+	copy(frame[rstHeaderLen:], reason)
+	copy(frame[payloadLen:], buf.streamID)
+	setFrameType(frame[payloadLen:], frameTypeRST)
+	buf.queue.send(frame)
 }
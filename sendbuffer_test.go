@@ -12,11 +12,12 @@ import (
 func TestSendBuffer(t *testing.T) {
 	id := make([]byte, idLen)
 	binaryEncoding.PutUint32(id, 27)
+	pool := &testpool{}
 
 	depth := 5
 
 	out := make(chan []byte)
-	buf := newSendBuffer(id, out, depth)
+	buf := newSendBuffer(id, schedulerTo(out), pool, depth, frameFlowControl, nil, DefaultCloseTimeout, false)
 	defer buf.close(false)
 
 	var mx sync.RWMutex
@@ -37,12 +38,12 @@ func TestSendBuffer(t *testing.T) {
 
 	// Should be able to write to twice depth with no problem
 	for i := 0; i < 2*depth; i++ {
-		buf.in <- []byte(fmt.Sprint(i))
+		buf.in <- frameOf(fmt.Sprint(i))
 	}
 
 	// Writing past depth should fail
 	select {
-	case buf.in <- []byte("fail"):
+	case buf.in <- frameOf("fail"):
 		assert.Fail(t, "Writing past buffer depth should have failed")
 		return
 	default:
@@ -56,15 +57,9 @@ func TestSendBuffer(t *testing.T) {
 	mx.RUnlock()
 	assert.Equal(t, "01234", string(_wrote))
 
-	// Make sure we can ack up to depth
+	// Ack up to depth
 	for i := 0; i < depth; i++ {
-		select {
-		case buf.ack <- true:
-			// good
-		default:
-			assert.Fail(t, "Failed to ack to buffer on iteration %d", i)
-			return
-		}
+		buf.credit.add(1)
 	}
 
 	time.Sleep(25 * time.Millisecond)
@@ -74,3 +69,132 @@ func TestSendBuffer(t *testing.T) {
 	mx.RUnlock()
 	assert.Equal(t, "0123456789", string(_wrote))
 }
+
+func TestSendBufferCloseWrite(t *testing.T) {
+	id := make([]byte, idLen)
+	binaryEncoding.PutUint32(id, 27)
+	pool := &testpool{}
+
+	depth := 5
+
+	out := make(chan []byte, 100)
+	buf := newSendBuffer(id, schedulerTo(out), pool, depth, frameFlowControl, nil, DefaultCloseTimeout, false)
+
+	buf.in <- frameOf("a")
+	buf.in <- frameOf("b")
+	buf.closeWrite()
+
+	expectFrame := func(expectedType byte, expectedData string) {
+		select {
+		case b := <-out:
+			dataLen := len(b) - idLen
+			assert.EqualValues(t, expectedType, frameType(b[dataLen:]))
+			assert.Equal(t, expectedData, string(b[:dataLen]))
+		case <-time.After(250 * time.Millisecond):
+			assert.Fail(t, "Timed out waiting for frame", "expected frame type %d", expectedType)
+		}
+	}
+
+	// Buffered frames should be sent before the FIN
+	expectFrame(frameTypeData, "a")
+	expectFrame(frameTypeData, "b")
+	expectFrame(frameTypeFIN, "")
+
+	select {
+	case <-out:
+		assert.Fail(t, "Nothing should be sent until the stream is closed")
+	case <-time.After(25 * time.Millisecond):
+		// good
+	}
+
+	buf.close(true)
+	expectFrame(frameTypeRST, "")
+}
+
+func TestSendBufferCloseCodes(t *testing.T) {
+	id := make([]byte, idLen)
+	binaryEncoding.PutUint32(id, 27)
+	pool := &testpool{}
+
+	out := make(chan []byte, 100)
+	buf := newSendBuffer(id, schedulerTo(out), pool, 1, frameFlowControl, nil, 25*time.Millisecond, true)
+
+	// Use up the credit so that the last frame can't be sent
+	buf.in <- frameOf("a")
+	buf.in <- frameOf("b")
+	buf.requestClose(closeRequest{sendRST: true, code: CloseRefused, reason: "no thanks"})
+
+	expectRST := func(expectedCode CloseCode, expectedReason string) {
+		for {
+			select {
+			case b := <-out:
+				payload := b[:len(b)-idLen]
+				if frameType(b[len(payload):]) != frameTypeRST {
+					continue
+				}
+				if assert.Len(t, payload, rstHeaderLen+len(expectedReason)) {
+					assert.Equal(t, expectedCode, CloseCode(binaryEncoding.Uint32(payload)))
+					assert.EqualValues(t, len(expectedReason), payload[closeCodeLen])
+					assert.Equal(t, expectedReason, string(payload[rstHeaderLen:]))
+				}
+				return
+			case <-time.After(250 * time.Millisecond):
+				assert.Fail(t, "Timed out waiting for RST")
+				return
+			}
+		}
+	}
+
+	// "b" never got sent, so the RST should say that we timed out
+	expectRST(CloseTimeout, "")
+	<-buf.done
+	assert.Equal(t, maxFrameLen, pool.getTotalReturned(), "Frame that wasn't sent should have been returned to the pool")
+
+	buf = newSendBuffer(id, schedulerTo(out), pool, 1, frameFlowControl, nil, DefaultCloseTimeout, true)
+	buf.requestClose(closeRequest{sendRST: true, code: CloseRefused, reason: "no thanks"})
+	expectRST(CloseRefused, "no thanks")
+}
+
+func TestSendBufferByteFlowControl(t *testing.T) {
+	id := make([]byte, idLen)
+	binaryEncoding.PutUint32(id, 27)
+	pool := &testpool{}
+
+	depth := 2
+
+	out := make(chan []byte, 100)
+	buf := newSendBuffer(id, schedulerTo(out), pool, depth, byteFlowControl, nil, DefaultCloseTimeout, false)
+	defer buf.close(false)
+
+	buf.in <- pool.Get()
+	buf.in <- pool.Get()[:MaxDataLen-1]
+	buf.in <- pool.Get()[:3]
+
+	time.Sleep(25 * time.Millisecond)
+	assert.Equal(t, 2, len(out), "Should only have sent up to window")
+
+	buf.credit.add(1)
+	time.Sleep(25 * time.Millisecond)
+	assert.Equal(t, 2, len(out), "Shouldn't have sent frame with insufficient credit")
+
+	buf.credit.add(1)
+	time.Sleep(25 * time.Millisecond)
+	assert.Equal(t, 3, len(out), "Should have sent frame once there was enough credit")
+}
+
+// frameOf puts the given data into a buffer like the ones that come from the
+// pool.
+func frameOf(data string) []byte {
+	return append(make([]byte, 0, maxFrameLen), data...)
+}
+
+// schedulerTo creates a streamQueue whose frames end up on out.
+func schedulerTo(out chan []byte) *streamQueue {
+	sched := newScheduler(make(chan []byte))
+	go func() {
+		for {
+			out <- sched.next()
+		}
+	}()
+	return sched.newQueue(DefaultStreamPriority)
+}
@@ -1,161 +1,589 @@
 package connmux
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+const (
+	// how much the sendLoop buffers before writing to the connection
+	writeBufferSize = 8 * maxFrameLen
+
+	// how much the recvLoop reads from the connection at a time
+	readBufferSize = 8 * maxFrameLen
+)
+
+var (
+	shutdownPollInterval = 50 * time.Millisecond
 )
 
 // session encapsulates the multiplexing of streams onto a single "physical"
 // net.Conn.
 type session struct {
+	lastPong    int64 // unix nanos, accessed atomically
+	smoothedRTT int64 // nanos, accessed atomically
+	sent        activity
+	received    activity
+	ackLatency  latencies
+	sentTypes   frameCounter
+	recvTypes   frameCounter
 	net.Conn
-	windowSize  int
-	pool        BufferPool
-	out         chan []byte
-	streams     map[uint32]*stream
-	closed      map[uint32]bool
-	connCh      chan net.Conn
-	beforeClose func(*session)
-	mx          sync.RWMutex
-}
-
-// startSession starts a session on the given net.Conn using the given transmit
-// windowSize and pool. If connCh is provided, the session will notify of new
-// streams as they are opened. If beforeClose is provided, the session will use
-// it to notify when it's about to close.
-func startSession(conn net.Conn, windowSize int, pool BufferPool, connCh chan net.Conn, beforeClose func(*session)) *session {
+	client            bool
+	version           byte
+	flowControl       flowControl
+	windowSize        int
+	sendCredit        *credit
+	recvWindow        *sessionWindow
+	autoTuning        *autoTuning
+	keepAliveInterval time.Duration
+	keepAliveTimeout  time.Duration
+	closeTimeout      time.Duration
+	pool              BufferPool
+	log               golog.Logger
+	hooks             Hooks
+	streamFilter      func(Stream) RefuseCode
+	out               chan []byte
+	sched             *scheduler
+	streamPriority    int
+	streams           map[uint32]*stream
+	nextID            uint32
+	usedIDs           [2]idTracker
+	sentGoAway        bool
+	receivedGoAway    bool
+	pingID            uint32
+	pingSentAt        time.Time
+	lastRTTSample     time.Time
+	connCh            chan net.Conn
+	acceptCh          chan *stream
+	beforeClose       func(*session)
+	closeErr          error
+	closeCh           chan struct{}
+	closeOnce         sync.Once
+	errOnce           sync.Once
+	mx                sync.RWMutex
+}
+
+// startSession starts a session on the given net.Conn using the negotiated
+// protocol version and transmit windowSize, with everything else configured by
+// cfg (which must already have defaults applied). Depending on the protocol
+// version, some of the options in cfg (session window, auto-tuning and
+// keepalives) may not be supported, in which case they're ignored. client
+// indicates whether we're the end that initiated the session, which opens
+// streams with odd ids (the other end uses even ids). New streams are queued in
+// an accept backlog. If connCh is provided, the session hands them from there
+// to connCh, otherwise they wait for AcceptStream. If beforeClose is provided, the session will use it
+// to notify when it's about to close.
+func startSession(conn net.Conn, client bool, version byte, windowSize int, cfg *Config, connCh chan net.Conn, beforeClose func(*session)) *session {
+	fc := frameFlowControl
+	if version >= protocolVersion3 {
+		fc = byteFlowControl
+	}
 	s := &session{
-		Conn:        conn,
-		windowSize:  windowSize,
-		pool:        pool,
-		out:         make(chan []byte),
-		streams:     make(map[uint32]*stream),
-		closed:      make(map[uint32]bool),
-		connCh:      connCh,
-		beforeClose: beforeClose,
+		lastPong:          time.Now().UnixNano(),
+		Conn:              conn,
+		client:            client,
+		version:           version,
+		flowControl:       fc,
+		windowSize:        windowSize,
+		keepAliveInterval: cfg.KeepAliveInterval,
+		keepAliveTimeout:  cfg.KeepAliveTimeout,
+		closeTimeout:      cfg.CloseTimeout,
+		pool:              cfg.Pool,
+		log:               cfg.Logger,
+		hooks:             cfg.Hooks,
+		streamFilter:      cfg.StreamFilter,
+		out:               make(chan []byte),
+		streams:           make(map[uint32]*stream),
+		nextID:            2,
+		connCh:            connCh,
+		beforeClose:       beforeClose,
+		closeCh:           make(chan struct{}),
+		streamPriority:    cfg.StreamPriority,
 	}
+	s.sched = newScheduler(s.out)
+	if client {
+		s.nextID = 1
+	}
+	s.acceptCh = make(chan *stream, cfg.AcceptBacklog)
+	if fc == byteFlowControl {
+		// The other end tells us how much we can send once the session starts
+		s.sendCredit = newCredit(0)
+		window := unlimitedSessionWindow
+		if cfg.SessionWindowSize > 0 {
+			window = byteWindow(cfg.SessionWindowSize)
+		}
+		s.recvWindow = newSessionWindow(window, s.out, s.closeCh)
+		if cfg.MaxWindowSize > 0 {
+			s.autoTuning = newAutoTuning(cfg.MinWindowSize, cfg.MaxWindowSize, s.rtt)
+		}
+	}
+	// Tell the hooks before anything can happen on the session
+	s.hooks.OnSessionStart(s)
 	go s.sendLoop()
+	if s.recvWindow != nil {
+		// Tell the other end how big our session window is before anything else
+		// gets sent. This goes through the sendLoop rather than being written
+		// directly so that we don't deadlock on unbuffered conns where both ends
+		// do this at the same time.
+		s.recvWindow.sendWindowUpdate(s.recvWindow.size)
+	}
 	go s.recvLoop()
+	if connCh != nil {
+		go s.acceptLoop()
+	}
+	if s.keepAliveInterval > 0 {
+		if s.supportsControlFrames() {
+			go s.keepAliveLoop()
+		} else {
+			s.log.Debugf("Protocol version %d doesn't support keepalives, not sending any", version)
+		}
+	}
 	return s
 }
 
+// recvLoop reads frames from the connection and dispatches them to streams.
+// Reads from the connection go through a buffer so that many small frames can
+// be parsed out of a single read, rather than reading each part of each frame
+// from the connection separately.
 func (s *session) recvLoop() {
+	r := bufio.NewReaderSize(s.Conn, readBufferSize)
+	// holds the id followed by either the data length or the fixed length
+	// payload of a control frame (the longest of which is the start of an rst;
+	// the metadata of a syn and the reason of an rst are read separately)
+	header := make([]byte, idLen+rstHeaderLen)
 	for {
-		b := s.pool.getForFrame()
 		// First read id
-		id := b[:idLen]
-		_, err := io.ReadFull(s, id)
+		id := header[:idLen]
+		_, err := io.ReadFull(r, id)
 		if err != nil {
 			s.onSessionError(err, nil)
 			return
 		}
+		s.received.record(0)
 
-		isACK := false
-		isRST := false
-		switch frameType(id) {
-		case frameTypeACK:
-			isACK = true
-		case frameTypeRST:
-			// Closing existing connection
-			isRST = true
-		}
+		ft := frameType(id)
+		s.recvTypes.count(ft, idLen)
 		setFrameType(id, frameTypeData)
 
 		_id := binaryEncoding.Uint32(id)
-		if isACK {
-			c, open := s.getOrCreateStream(_id)
+		switch ft {
+		case frameTypeACK:
+			c, open := s.getStream(_id)
+			if !open {
+				// Stream was already closed, ignore
+				s.dropFrame(_id, ft)
+				continue
+			}
+			s.onACK(c, 1)
+			continue
+		case frameTypeWindowUpdate:
+			increment := header[idLen : idLen+windowUpdateLen]
+			_, err = io.ReadFull(r, increment)
+			if err != nil {
+				s.onSessionError(err, nil)
+				return
+			}
+			s.recvTypes.addBytes(ft, windowUpdateLen)
+			if _id == 0 {
+				// Stream id 0 refers to the session as a whole
+				if s.sendCredit != nil {
+					s.sendCredit.add(int(binaryEncoding.Uint32(increment)))
+				}
+				continue
+			}
+			c, open := s.getStream(_id)
 			if !open {
 				// Stream was already closed, ignore
+				s.dropFrame(_id, ft)
 				continue
 			}
-			c.sb.ack <- true
+			s.onACK(c, int(binaryEncoding.Uint32(increment)))
+			continue
+		case frameTypeSYN:
+			var md Metadata
+			if s.supportsStreamMetadata() {
+				md, err = s.readMetadata(r, header[idLen:idLen+metadataLenLen])
+				if err != nil {
+					s.onSessionError(err, nil)
+					return
+				}
+			}
+			s.onSYN(_id, md)
 			continue
-		} else if isRST {
+		case frameTypeSYNACK:
+			s.mx.RLock()
+			c := s.streams[_id]
+			s.mx.RUnlock()
+			if c == nil {
+				s.dropFrame(_id, ft)
+				continue
+			}
+			s.notifyOpen(c)
+			c.onOpened(nil)
+			continue
+		case frameTypeREFUSE:
+			code := header[idLen : idLen+refuseCodeLen]
+			_, err = io.ReadFull(r, code)
+			if err != nil {
+				s.onSessionError(err, nil)
+				return
+			}
+			s.recvTypes.addBytes(ft, refuseCodeLen)
+			s.onRefused(_id, RefuseCode(binaryEncoding.Uint32(code)))
+			continue
+		case frameTypeRST:
+			// Closing existing connection
+			var closedErr error
+			if s.supportsCloseCodes() {
+				code, reason, err := s.readCloseReason(r, header[idLen:idLen+rstHeaderLen])
+				if err != nil {
+					s.onSessionError(err, nil)
+					return
+				}
+				if code != CloseNormal {
+					closedErr = &StreamClosedError{Code: code, Reason: reason}
+				}
+			}
 			s.mx.Lock()
 			c := s.streams[_id]
 			delete(s.streams, _id)
-			s.closed[_id] = true
+			if c == nil && s.usedIDs[_id%2].reached(_id) {
+				// Stream hasn't been opened yet but was about to be, make sure that it
+				// doesn't get opened if its frames arrive after the RST.
+				s.usedIDs[_id%2].use(_id)
+			}
 			s.mx.Unlock()
-			if c != nil {
-				// Close, but don't send an RST back the other way since the other end is
-				// already closed.
-				c.close(false, nil, nil)
+			if c == nil {
+				s.dropFrame(_id, ft)
+				continue
+			}
+			// Close, but don't send an RST back the other way since the other end is
+			// already closed.
+			c.closeByPeer(closedErr)
+			continue
+		case frameTypeFIN:
+			// Other end is done writing
+			c, open := s.getStream(_id)
+			if !open {
+				// Stream was already closed, ignore
+				s.dropFrame(_id, ft)
+				continue
+			}
+			// Reads will drain whatever is already queued and then return io.EOF
+			c.rb.close()
+			continue
+		case frameTypePING:
+			// Respond with a pong that echoes the ping
+			setFrameType(id, frameTypePONG)
+			pong := make([]byte, idLen)
+			copy(pong, id)
+			select {
+			case s.out <- pong:
+				// okay
+			case <-s.closeCh:
+				// session closed, nobody is waiting for the pong anymore
 			}
 			continue
+		case frameTypePONG:
+			s.onPong(_id)
+			continue
+		case frameTypeGOAWAY:
+			// Other end won't accept new streams anymore
+			s.mx.Lock()
+			s.receivedGoAway = true
+			s.mx.Unlock()
+			continue
 		}
 
 		// Read frame length
-		dataLength := b[idLen:frameHeaderLen]
-		_, err = io.ReadFull(s, dataLength)
+		dataLength := header[idLen:frameHeaderLen]
+		_, err = io.ReadFull(r, dataLength)
 		if err != nil {
 			s.onSessionError(err, nil)
 			return
 		}
 
 		_dataLength := int(binaryEncoding.Uint16(dataLength))
+		s.received.addBytes(_dataLength)
+		s.recvTypes.addBytes(ft, lenLen+_dataLength)
 
-		// Read frame
-		b = b[:frameHeaderLen+_dataLength]
-		_, err = io.ReadFull(s, b[frameHeaderLen:])
+		// Read frame data into the start of a pooled buffer, so that it can be
+		// handed to the application as is
+		b := s.pool.Get()[:_dataLength]
+		_, err = io.ReadFull(r, b)
 		if err != nil {
+			s.pool.Put(b[:maxFrameLen])
 			s.onSessionError(err, nil)
 			return
 		}
 
-		c, open := s.getOrCreateStream(_id)
+		c, open := s.getStream(_id)
 		if !open {
-			// Stream was already closed, ignore
+			// Stream was already closed or never opened, ignore (but give the
+			// data's share of the session window back)
+			s.pool.Put(b[:maxFrameLen])
+			s.dropFrame(_id, ft)
+			if s.recvWindow != nil {
+				if !s.recvWindow.reserve(_dataLength) {
+					s.onSessionError(ErrFlowControlViolation, nil)
+					return
+				}
+				s.recvWindow.release(_dataLength)
+			}
 			continue
 		}
-		c.rb.submit(b)
+		err = c.rb.submit(b)
+		if err != nil {
+			s.onSessionError(err, nil)
+			return
+		}
+		if s.autoTuning != nil {
+			s.measureRTT()
+		}
+	}
+}
+
+// readMetadata reads the metadata that follows the id of a syn frame, using
+// header to hold the metadata length.
+func (s *session) readMetadata(r io.Reader, header []byte) (Metadata, error) {
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	mdLen := int(binaryEncoding.Uint16(header))
+	if mdLen > MaxMetadataLen {
+		return nil, ErrInvalidMetadata
+	}
+	b := make([]byte, mdLen)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
 	}
+	s.recvTypes.addBytes(frameTypeSYN, len(header)+mdLen)
+	return decodeMetadata(b)
 }
 
+// readCloseReason reads the code and reason that follow the id of an rst frame,
+// using header to hold the code and reason length.
+func (s *session) readCloseReason(r io.Reader, header []byte) (CloseCode, string, error) {
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, "", err
+	}
+	reason := make([]byte, header[closeCodeLen])
+	_, err = io.ReadFull(r, reason)
+	if err != nil {
+		return 0, "", err
+	}
+	s.recvTypes.addBytes(frameTypeRST, len(header)+len(reason))
+	return CloseCode(binaryEncoding.Uint32(header)), string(reason), nil
+}
+
+// sendLoop writes frames to the connection as the scheduler hands them out. To
+// cut down on syscalls (and on TLS records, if the connection is encrypted),
+// frames are coalesced in a buffer for as long as more frames are immediately
+// available, and only then flushed to the connection.
 func (s *session) sendLoop() {
-	for frame := range s.out {
-		dataLen := len(frame) - idLen
-		if dataLen > MaxDataLen {
-			panic(fmt.Sprintf("Data length of %d exceeds maximum allowed of %d", dataLen, MaxDataLen))
+	w := bufio.NewWriterSize(s.Conn, writeBufferSize)
+	length := make([]byte, lenLen)
+	for {
+		frame := s.sched.next()
+		for frame != nil {
+			err := s.writeFrame(w, frame, length)
+			if err != nil {
+				s.onSessionError(nil, err)
+				s.dropPending()
+				return
+			}
+			frame = s.sched.tryNext()
 		}
-		id := frame[dataLen:]
-		_, err := s.Write(id)
+		err := w.Flush()
 		if err != nil {
 			s.onSessionError(nil, err)
+			s.dropPending()
 			return
 		}
-		if frameType(id) != frameTypeData {
-			// This is a special control message, no data included
-			continue
+	}
+}
+
+// dropPending stops the scheduler and returns the data frames that will never
+// be sent to the pool.
+func (s *session) dropPending() {
+	for _, frame := range s.sched.close() {
+		if frameType(frame[len(frame)-idLen:]) == frameTypeData {
+			s.pool.Put(frame[:maxFrameLen])
 		}
-		length := make([]byte, lenLen)
-		binaryEncoding.PutUint16(length, uint16(dataLen))
-		_, err = s.Write(length)
-		if err != nil {
-			s.onSessionError(nil, err)
-			return
+	}
+}
+
+// writeFrame writes a single frame to w, using length as scratch space for
+// encoding the data length.
+func (s *session) writeFrame(w *bufio.Writer, frame []byte, length []byte) error {
+	dataLen := len(frame) - idLen
+	if dataLen > MaxDataLen {
+		panic(fmt.Sprintf("Data length of %d exceeds maximum allowed of %d", dataLen, MaxDataLen))
+	}
+	id := frame[dataLen:]
+	if frameType(id) == frameTypeData {
+		// Put frame back in pool once it's been written (or failed to)
+		defer s.pool.Put(frame[:maxFrameLen])
+	}
+	_, err := w.Write(id)
+	if err != nil {
+		return err
+	}
+	if frameType(id) != frameTypeData {
+		s.sent.record(0)
+		s.sentTypes.count(frameType(id), len(frame))
+		// This is a special control message, its payload (if any) has a length
+		// that's implied by the frame type (or, for rsts, given in the payload)
+		if dataLen > 0 {
+			_, err = w.Write(frame[:dataLen])
 		}
-		_, err = s.Write(frame[:dataLen])
-		// Put frame back in pool
-		s.pool.Put(frame[:maxFrameLen])
-		if err != nil {
-			s.onSessionError(nil, err)
+		return err
+	}
+	binaryEncoding.PutUint16(length, uint16(dataLen))
+	_, err = w.Write(length)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame[:dataLen])
+	s.sent.record(dataLen)
+	s.sentTypes.count(frameTypeData, lenLen+len(frame))
+	return err
+}
+
+// onACK handles the other end acknowledging data that we sent on the given
+// stream, granting the stream more credit.
+func (s *session) onACK(c *stream, credit int) {
+	latency := c.sb.onACK(credit)
+	if latency > 0 {
+		s.ackLatency.record(latency)
+	}
+}
+
+// keepAliveLoop periodically pings the other end and fails the session if it
+// stops receiving pongs.
+func (s *session) keepAliveLoop() {
+	ticker := time.NewTicker(s.keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeCh:
 			return
+		case <-ticker.C:
+			lastPong := time.Unix(0, atomic.LoadInt64(&s.lastPong))
+			if time.Since(lastPong) > s.keepAliveTimeout {
+				s.log.Debugf("No pong received in %v, closing session", s.keepAliveTimeout)
+				s.onSessionError(ErrKeepAliveTimeout, nil)
+				return
+			}
+			s.ping()
 		}
 	}
 }
 
+// ping sends a ping to the other end, remembering when it was sent so that we
+// can measure the round trip time once the pong comes back. Only the most
+// recent ping is used for measuring.
+func (s *session) ping() {
+	s.mx.Lock()
+	// The ping id has to fit in the 3 byte stream id portion of the frame
+	s.pingID = (s.pingID + 1) & 0xFFFFFF
+	ping := make([]byte, idLen)
+	binaryEncoding.PutUint32(ping, s.pingID)
+	setFrameType(ping, frameTypePING)
+	s.pingSentAt = time.Now()
+	s.mx.Unlock()
+
+	select {
+	case s.out <- ping:
+		// okay
+	case <-s.closeCh:
+		// session closed
+	}
+}
+
+func (s *session) onPong(id uint32) {
+	now := time.Now()
+	atomic.StoreInt64(&s.lastPong, now.UnixNano())
+
+	s.mx.Lock()
+	if id != s.pingID || s.pingSentAt.IsZero() {
+		// Not the most recent ping, ignore
+		s.mx.Unlock()
+		return
+	}
+	sample := now.Sub(s.pingSentAt)
+	s.pingSentAt = time.Time{}
+	s.lastRTTSample = now
+	s.mx.Unlock()
+
+	// Smooth the RTT like TCP does
+	rtt := time.Duration(atomic.LoadInt64(&s.smoothedRTT))
+	if rtt == 0 {
+		rtt = sample
+	} else {
+		rtt += (sample - rtt) / 8
+	}
+	atomic.StoreInt64(&s.smoothedRTT, int64(rtt))
+}
+
+// measureRTT pings the other end if we haven't measured the round trip time in
+// a while and aren't already waiting for a pong.
+func (s *session) measureRTT() {
+	s.mx.RLock()
+	due := s.pingSentAt.IsZero() && time.Since(s.lastRTTSample) > rttSampleInterval
+	s.mx.RUnlock()
+	if due {
+		s.ping()
+	}
+}
+
+// rtt returns the smoothed round trip time to the other end, or 0 if it hasn't
+// been measured yet.
+func (s *session) rtt() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.smoothedRTT))
+}
+
 func (s *session) onSessionError(readErr error, writeErr error) {
+	// Only the first error matters, subsequent errors are usually just a
+	// consequence of having closed the physical connection.
+	s.errOnce.Do(func() {
+		s.doOnSessionError(readErr, writeErr)
+	})
+}
+
+func (s *session) doOnSessionError(readErr error, writeErr error) {
+	select {
+	case <-s.closeCh:
+		// Already closed intentionally, error is just a consequence of that
+	default:
+		s.mx.Lock()
+		s.closeErr = readErr
+		if s.closeErr == nil {
+			s.closeErr = writeErr
+		}
+		s.mx.Unlock()
+	}
 	s.Close()
 
 	if readErr != nil {
-		log.Errorf("Error on reading: %v", readErr)
+		s.log.Errorf("Error on reading: %v", readErr)
 	} else {
 		readErr = ErrBrokenPipe
 	}
 	if writeErr != nil {
-		log.Errorf("Error on writing: %v", writeErr)
+		s.log.Errorf("Error on writing: %v", writeErr)
 	} else {
 		writeErr = ErrBrokenPipe
 	}
@@ -166,56 +594,495 @@ func (s *session) onSessionError(readErr error, writeErr error) {
 		readErr = io.ErrUnexpectedEOF
 	}
 	s.mx.RLock()
+	closeErr := s.closeErr
 	streams := make([]*stream, 0, len(s.streams))
 	for _, c := range s.streams {
 		streams = append(streams, c)
 	}
 	s.mx.RUnlock()
+	reason := closeErr
+	if reason == nil {
+		// Session was closed intentionally
+		reason = ErrConnectionClosed
+	}
 	for _, c := range streams {
 		// Note - we never send an RST because the underlying connection is
 		// considered no good at this point and we won't bother sending anything.
-		c.close(false, readErr, writeErr)
+		c.close(false, readErr, writeErr, reason)
+		// Reads fail from here on, so nothing buffered will ever be read
+		c.rb.drain()
 	}
+	s.hooks.OnSessionClose(s, closeErr)
 }
 
-func (s *session) getOrCreateStream(id uint32) (*stream, bool) {
+// getStream finds the stream that an incoming frame with the given id belongs
+// to. Before protocol version 4, streams are opened implicitly by the first
+// frame that arrives for them. From version 4 on, streams have to be opened
+// with a SYN, so this only finds streams that are already open.
+func (s *session) getStream(id uint32) (*stream, bool) {
+	if !s.supportsStreamOpen() {
+		return s.getOrCreateStream(context.Background(), id)
+	}
+	s.mx.RLock()
+	c := s.streams[id]
+	s.mx.RUnlock()
+	return c, c != nil
+}
+
+// getOrCreateStream finds the stream with the given id, creating it with the
+// given context if it hasn't been opened yet.
+func (s *session) getOrCreateStream(ctx context.Context, id uint32) (*stream, bool) {
 	s.mx.Lock()
 	c := s.streams[id]
 	if c != nil {
 		s.mx.Unlock()
 		return c, true
 	}
-	closed := s.closed[id]
-	if closed {
+	if s.usedIDs[id%2].isUsed(id) {
+		// Stream was already closed
 		s.mx.Unlock()
 		return nil, false
 	}
+	c = s.newStream(ctx, id)
+	s.mx.Unlock()
+	s.notifyOpen(c)
+	if s.connCh != nil || !s.client {
+		s.deliver(c)
+	}
+	return c, true
+}
 
+// newStream creates a stream with the given id and adds it to the session. The
+// stream keeps ctx's values (but not its deadline or cancellation) for
+// Stream.Context. Must be called with mx held.
+func (s *session) newStream(ctx context.Context, id uint32) *stream {
 	_id := make([]byte, idLen)
 	binaryEncoding.PutUint32(_id, id)
-	c = &stream{
-		Conn:    s,
-		id:      _id,
-		session: s,
-		pool:    s.pool,
-		rb:      newReceiveBuffer(_id, s.out, s.pool, s.windowSize),
-		sb:      newSendBuffer(_id, s.out, s.windowSize),
+	c := &stream{
+		Conn:     s,
+		ctx:      context.WithoutCancel(ctx),
+		metadata: MetadataFromContext(ctx),
+		id:       _id,
+		session:  s,
+		pool:     s.pool,
+		rb:       newReceiveBuffer(_id, s.out, s.closeCh, s.pool, s.windowSize, s.flowControl, s.recvWindow, s.autoTuning),
+		sb:       newSendBuffer(_id, s.sched.newQueue(s.streamPriority), s.pool, s.windowSize, s.flowControl, s.sendCredit, s.closeTimeout, s.supportsCloseCodes()),
 	}
 	s.streams[id] = c
+	s.usedIDs[id%2].use(id)
+	return c
+}
+
+// deliver queues a stream that the other end opened in the accept backlog.
+// Before protocol version 4 there's no way to refuse a stream, so if the
+// backlog is full this waits until there's room.
+func (s *session) deliver(c *stream) {
+	select {
+	case s.acceptCh <- c:
+		// okay
+	case <-s.closeCh:
+		// session closed before anyone accepted the stream
+	}
+}
+
+// acceptLoop hands streams from the accept backlog to the Listener as it
+// accepts them, so that a slow Accept doesn't hold up the recvLoop.
+func (s *session) acceptLoop() {
+	for {
+		select {
+		case c := <-s.acceptCh:
+			select {
+			case s.connCh <- c:
+				// okay
+			case <-s.closeCh:
+				// session closed before anyone accepted the stream
+				return
+			}
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+// enqueue queues a stream that the other end opened in the accept backlog
+// without waiting, returning RefuseOverloaded if the backlog is full.
+func (s *session) enqueue(c *stream) RefuseCode {
+	select {
+	case s.acceptCh <- c:
+		return RefuseNone
+	default:
+		return RefuseOverloaded
+	}
+}
+
+// OpenStream implements the method from Session
+func (s *session) OpenStream() (Stream, error) {
+	return s.OpenStreamContext(context.Background())
+}
+
+// OpenStreamContext implements the method from Session
+func (s *session) OpenStreamContext(ctx context.Context) (Stream, error) {
+	c, err := s.openNextStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// openNextStream opens a new stream using the next id from our end's id space.
+func (s *session) openNextStream(ctx context.Context) (*stream, error) {
+	if !s.client && !s.supportsStreamOpen() {
+		// Before version 4, only clients can open streams
+		return nil, ErrUnsupported
+	}
+	ctx = s.hooks.OnStreamOpening(ctx)
+	md := MetadataFromContext(ctx)
+	if len(md) > 0 && !s.supportsStreamMetadata() {
+		return nil, ErrUnsupported
+	}
+	encodedMD, err := md.encode()
+	if err != nil {
+		return nil, err
+	}
+	s.mx.Lock()
+	id := s.nextID
+	if id > maxStreamID {
+		s.mx.Unlock()
+		return nil, ErrStreamIDsExhausted
+	}
+	s.nextID += 2
 	s.mx.Unlock()
-	if s.connCh != nil {
-		s.connCh <- c
+	return s.openStream(ctx, id, encodedMD)
+}
+
+// AcceptStream implements the method from Session
+func (s *session) AcceptStream() (Stream, error) {
+	if s.connCh != nil || (s.client && !s.supportsStreamOpen()) {
+		return nil, ErrUnsupported
+	}
+	select {
+	case c := <-s.acceptCh:
+		return c, nil
+	case <-s.closeCh:
+		return nil, ErrConnectionClosed
+	}
+}
+
+// openStream opens a new stream with the given id. From protocol version 4 on,
+// this sends a SYN and waits for the other end to accept or refuse the stream,
+// giving up if ctx is done first. From version 6 on, the SYN carries the given
+// encoded metadata.
+func (s *session) openStream(ctx context.Context, id uint32, encodedMD []byte) (*stream, error) {
+	if !s.supportsStreamOpen() {
+		c, open := s.getOrCreateStream(ctx, id)
+		if !open {
+			// The other end already closed a stream with this id
+			return nil, ErrConnectionClosed
+		}
+		return c, nil
+	}
+
+	s.mx.Lock()
+	c := s.newStream(ctx, id)
+	c.opened = make(chan error, 1)
+	s.mx.Unlock()
+
+	var syn []byte
+	if s.supportsStreamMetadata() {
+		syn = make([]byte, metadataLenLen+len(encodedMD)+idLen)
+		binaryEncoding.PutUint16(syn, uint16(len(encodedMD)))
+		copy(syn[metadataLenLen:], encodedMD)
+	} else {
+		syn = make([]byte, idLen)
+	}
+	copy(syn[len(syn)-idLen:], c.id)
+	setFrameType(syn[len(syn)-idLen:], frameTypeSYN)
+	select {
+	case s.out <- syn:
+		// wait for reply
+	case <-s.closeCh:
+		return nil, ErrConnectionClosed
+	case <-ctx.Done():
+		// Other end doesn't know about the stream yet, no need for an RST
+		c.close(false, ErrConnectionClosed, ErrConnectionClosed, nil)
+		return nil, ctx.Err()
+	}
+
+	select {
+	case err := <-c.opened:
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case <-s.closeCh:
+		return nil, ErrConnectionClosed
+	case <-ctx.Done():
+		c.CloseWithError(CloseCanceled, "")
+		return nil, ctx.Err()
+	}
+}
+
+// onSYN handles a request from the other end to open a new stream with the
+// given metadata, which we either accept or refuse depending on the
+// streamFilter.
+func (s *session) onSYN(id uint32, md Metadata) {
+	if s.isLocalID(id) {
+		s.log.Debugf("Ignoring SYN for stream %d from our own id space", id)
+		return
+	}
+	s.mx.Lock()
+	if s.usedIDs[id%2].isUsed(id) {
+		s.mx.Unlock()
+		s.log.Debugf("Ignoring SYN for stream %d that was already opened", id)
+		return
+	}
+	c := s.newStream(context.Background(), id)
+	c.metadata = md
+	s.mx.Unlock()
+
+	code := RefuseNone
+	if s.streamFilter != nil {
+		code = s.streamFilter(c)
+	}
+	if code != RefuseNone {
+		s.refuse(c, code)
+		return
+	}
+	s.notifyOpen(c)
+	code = s.enqueue(c)
+	if code != RefuseNone {
+		s.refuse(c, code)
+		return
+	}
+
+	// Tell the other end right away rather than waiting for the stream to be
+	// accepted, so that opening streams doesn't depend on how quickly the
+	// application calls Accept.
+	synAck := make([]byte, idLen)
+	copy(synAck, c.id)
+	setFrameType(synAck, frameTypeSYNACK)
+	select {
+	case s.out <- synAck:
+		// okay
+	case <-s.closeCh:
+		// session closed before we could accept the stream
 	}
-	return c, true
+}
+
+// notifyOpen tells the hooks that the given stream has been opened, unless it
+// has already been closed.
+func (s *session) notifyOpen(c *stream) {
+	c.mx.Lock()
+	if c.closed {
+		c.mx.Unlock()
+		return
+	}
+	c.notifiedOpen = true
+	c.mx.Unlock()
+	s.hooks.OnStreamOpen(c)
+}
+
+// dropFrame tells the hooks that we've dropped a frame of the given type
+// because the stream with the given id isn't open.
+func (s *session) dropFrame(id uint32, ft byte) {
+	s.hooks.OnFrameDropped(s, id, frameTypeName(ft))
+}
+
+// refuse tells the other end that we won't open the given stream and forgets
+// about it.
+func (s *session) refuse(c *stream, code RefuseCode) {
+	// The other end forgets about the stream when it gets the REFUSE, so don't
+	// send an RST
+	c.close(false, ErrConnectionClosed, ErrConnectionClosed, &StreamRefusedError{Code: code})
+	frame := make([]byte, refuseCodeLen+idLen)
+	binaryEncoding.PutUint32(frame, uint32(code))
+	copy(frame[refuseCodeLen:], c.id)
+	setFrameType(frame[refuseCodeLen:], frameTypeREFUSE)
+	select {
+	case s.out <- frame:
+		// okay
+	case <-s.closeCh:
+		// session closed, nobody is waiting for a reply anymore
+	}
+}
+
+// onRefused handles the other end refusing a stream that we tried to open.
+func (s *session) onRefused(id uint32, code RefuseCode) {
+	s.mx.RLock()
+	c := s.streams[id]
+	s.mx.RUnlock()
+	if c == nil {
+		return
+	}
+	c.close(false, ErrConnectionClosed, ErrConnectionClosed, nil)
+	c.onOpened(&StreamRefusedError{Code: code})
+}
+
+// removeStream forgets about the stream with the given id once it has been
+// closed locally and all of its pending frames have been sent.
+func (s *session) removeStream(id uint32) {
+	s.mx.Lock()
+	delete(s.streams, id)
+	s.mx.Unlock()
+}
+
+// NumStreams implements the method from Session
+func (s *session) NumStreams() int {
+	s.mx.RLock()
+	n := len(s.streams)
+	s.mx.RUnlock()
+	return n
+}
+
+// Stats implements the method from Session
+func (s *session) Stats() SessionStats {
+	stats := SessionStats{
+		BytesSent:      s.sent.getBytes(),
+		BytesReceived:  s.received.getBytes(),
+		FramesSent:     s.sent.getFrames(),
+		FramesReceived: s.received.getFrames(),
+		QueuedFrames:   s.sched.numPending(),
+		LastActivity:   lastActivity(&s.sent, &s.received),
+		RTT:            s.rtt(),
+		SentByType:     s.sentTypes.snapshot(),
+		ReceivedByType: s.recvTypes.snapshot(),
+		ACKs:           s.ackLatency.getCount(),
+		ACKLatency:     s.ackLatency.getTotal(),
+	}
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	stats.Streams = len(s.streams)
+	for _, c := range s.streams {
+		stats.QueuedFrames += c.sb.queuedFrames()
+		stats.BufferedBytes += c.sb.bufferedBytes()
+	}
+	return stats
+}
+
+// load reports how busy this session is.
+func (s *session) load() SessionLoad {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	load := SessionLoad{Streams: len(s.streams)}
+	for _, c := range s.streams {
+		load.BufferedBytes += c.sb.bufferedBytes()
+	}
+	return load
+}
+
+// streamIDsExhausted indicates whether our end has used up all of its stream
+// ids, in which case no more streams can be opened on this session.
+func (s *session) streamIDsExhausted() bool {
+	s.mx.RLock()
+	exhausted := s.nextID > maxStreamID
+	s.mx.RUnlock()
+	return exhausted
+}
+
+// isGoingAway indicates whether either end has signaled that it won't accept
+// new streams on this session.
+func (s *session) isGoingAway() bool {
+	s.mx.RLock()
+	goingAway := s.sentGoAway || s.receivedGoAway
+	s.mx.RUnlock()
+	return goingAway
+}
+
+// Shutdown gracefully shuts down the session. It sends a GOAWAY to tell the
+// other end to stop opening new streams, waits for existing streams to finish
+// and then closes the session. If ctx is done before all streams have
+// finished, the session is closed anyway and ctx.Err() is returned.
+//
+// Streams that the other end opened before it received the GOAWAY are still
+// accepted. Protocol version 1 doesn't support GOAWAY, so with version 1 peers
+// Shutdown just waits for existing streams to finish.
+func (s *session) Shutdown(ctx context.Context) error {
+	s.mx.Lock()
+	sendGoAway := !s.sentGoAway
+	s.sentGoAway = true
+	s.mx.Unlock()
+
+	if sendGoAway && s.supportsControlFrames() {
+		goAway := make([]byte, idLen)
+		setFrameType(goAway, frameTypeGOAWAY)
+		select {
+		case s.out <- goAway:
+			// okay
+		case <-s.closeCh:
+			return nil
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		}
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.NumStreams() == 0 {
+			return s.Close()
+		}
+		select {
+		case <-s.closeCh:
+			return nil
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+			// check again
+		}
+	}
+}
+
+// isLocalID indicates whether the given stream id belongs to the id space for
+// streams opened by our end.
+func (s *session) isLocalID(id uint32) bool {
+	return (id%2 == 1) == s.client
+}
+
+// supportsStreamOpen indicates whether the negotiated protocol version opens
+// streams explicitly with syn, syn-ack and refuse frames.
+func (s *session) supportsStreamOpen() bool {
+	return s.version >= protocolVersion4
+}
+
+// supportsStreamMetadata indicates whether the negotiated protocol version
+// carries metadata in syn frames.
+func (s *session) supportsStreamMetadata() bool {
+	return s.version >= protocolVersion6
+}
+
+// supportsCloseCodes indicates whether the negotiated protocol version carries
+// a close code and reason in rst frames.
+func (s *session) supportsCloseCodes() bool {
+	return s.version >= protocolVersion5
+}
+
+// supportsControlFrames indicates whether the negotiated protocol version
+// supports the fin, ping, pong and goaway frames.
+func (s *session) supportsControlFrames() bool {
+	return s.version >= protocolVersion2
 }
 
 func (s *session) Close() error {
-	if s.beforeClose != nil {
+	closing := false
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		closing = true
+	})
+	if closing && s.beforeClose != nil {
 		s.beforeClose(s)
 	}
+	// Closing the connection makes recvLoop fail, which closes the streams and
+	// calls OnSessionClose (see doOnSessionError)
 	return s.Conn.Close()
 }
 
+// CloseChan implements the method from Session
+func (s *session) CloseChan() <-chan struct{} {
+	return s.closeCh
+}
+
 func (s *session) Wrapped() net.Conn {
 	return s.Conn
 }
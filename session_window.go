@@ -0,0 +1,80 @@
+package connmux
+
+import (
+	"sync"
+)
+
+// sessionWindow is the receive window shared by all of a session's streams. It
+// bounds how much data the other end can have outstanding across all streams
+// combined, on top of the per-stream windows, so that memory use doesn't grow
+// with the number of streams.
+//
+// Like the per-stream windows with byteFlowControl, it counts bytes. Frames
+// reserve space in the window as they're received and release it once they've
+// been read by the application (or discarded). Once half of the window has
+// been released, we grant the sender more credit with a window update for
+// stream id 0.
+//
+// Note that a stream whose data isn't being read holds on to its share of the
+// session window, which can stall the session's other streams until that data
+// is read or the stream is closed.
+type sessionWindow struct {
+	size        int
+	outstanding int
+	unacked     int
+	out         chan []byte
+	closeCh     chan struct{}
+	mx          sync.Mutex
+}
+
+func newSessionWindow(size int, out chan []byte, closeCh chan struct{}) *sessionWindow {
+	return &sessionWindow{
+		size:    size,
+		out:     out,
+		closeCh: closeCh,
+	}
+}
+
+// reserve accounts for n bytes having been received, returning false if that
+// exceeds the window.
+func (w *sessionWindow) reserve(n int) bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.outstanding+n > w.size {
+		return false
+	}
+	w.outstanding += n
+	return true
+}
+
+// release gives back n previously reserved bytes and sends a window update
+// once enough bytes have been released.
+func (w *sessionWindow) release(n int) {
+	if n == 0 {
+		return
+	}
+	w.mx.Lock()
+	w.unacked += n
+	increment := 0
+	if w.unacked >= w.size/2 {
+		increment = w.unacked
+		w.unacked = 0
+		w.outstanding -= increment
+	}
+	w.mx.Unlock()
+	if increment > 0 {
+		w.sendWindowUpdate(increment)
+	}
+}
+
+func (w *sessionWindow) sendWindowUpdate(increment int) {
+	frame := make([]byte, windowUpdateLen+idLen)
+	binaryEncoding.PutUint32(frame, uint32(increment))
+	setFrameType(frame[windowUpdateLen:], frameTypeWindowUpdate)
+	select {
+	case w.out <- frame:
+		// okay
+	case <-w.closeCh:
+		// session closed, nobody to tell
+	}
+}
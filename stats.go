@@ -0,0 +1,213 @@
+package connmux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats is a snapshot of what a Session is doing (see Session.Stats).
+type SessionStats struct {
+	// Streams is the number of open streams on the Session.
+	Streams int
+
+	// BytesSent and BytesReceived count the data carried by data frames, not
+	// including frame headers.
+	BytesSent     int64
+	BytesReceived int64
+
+	// FramesSent and FramesReceived count all frames, including control frames
+	// like ACKs and pings.
+	FramesSent     int64
+	FramesReceived int64
+
+	// QueuedFrames is the number of frames that are waiting to be sent, either
+	// in the streams' send buffers or in the Session's scheduler.
+	QueuedFrames int
+
+	// BufferedBytes is the number of bytes that have been written to the
+	// Session's streams but not yet sent.
+	BufferedBytes int
+
+	// LastActivity is when the Session last sent or received a frame.
+	LastActivity time.Time
+
+	// RTT is the smoothed round trip time to the other end, or 0 if it hasn't
+	// been measured.
+	RTT time.Duration
+
+	// SentByType and ReceivedByType break FramesSent and FramesReceived down by
+	// frame type ("data", "ack", "rst", etc.).
+	SentByType     map[string]FrameStats
+	ReceivedByType map[string]FrameStats
+
+	// ACKs and ACKLatency measure how long streams wait for the other end to
+	// acknowledge the data they send (with ACKs or window updates). Whenever an
+	// acknowledgement arrives for a stream that has sent data since the previous
+	// one, ACKs goes up by one and ACKLatency by the time since the stream
+	// first sent that data. ACKLatency / ACKs is the average ACK latency.
+	ACKs       int64
+	ACKLatency time.Duration
+}
+
+// FrameStats counts the frames of one type that went in one direction.
+type FrameStats struct {
+	// Frames is the number of frames.
+	Frames int64
+
+	// Bytes is the number of bytes that the frames took up on the connection,
+	// including headers.
+	Bytes int64
+}
+
+// StreamStats is a snapshot of what a Stream is doing (see Stream.Stats).
+type StreamStats struct {
+	// BytesSent and BytesReceived count the data sent and received on the
+	// Stream.
+	BytesSent     int64
+	BytesReceived int64
+
+	// FramesSent and FramesReceived count the data frames sent and received on
+	// the Stream.
+	FramesSent     int64
+	FramesReceived int64
+
+	// QueuedFrames is the number of frames that have been written to the Stream
+	// but not yet sent.
+	QueuedFrames int
+
+	// BufferedBytes is the number of bytes that have been written to the Stream
+	// but not yet sent.
+	BufferedBytes int
+
+	// SendCredit is how much more the Stream can send before it has to wait for
+	// the other end to acknowledge what it has received. Depending on the
+	// protocol version, this is counted in frames or in bytes. A Stream that's
+	// stuck with no SendCredit is waiting for the other end to read.
+	SendCredit int
+
+	// PendingACKs is how much received data we haven't acknowledged to the
+	// other end yet, counted the same way as SendCredit.
+	PendingACKs int
+
+	// LastActivity is when the Stream last sent or received data.
+	LastActivity time.Time
+}
+
+// activity counts the frames and bytes going through a session or stream in
+// one direction.
+type activity struct {
+	bytes  int64 // accessed atomically
+	frames int64 // accessed atomically
+	last   int64 // unix nanos, accessed atomically
+}
+
+// record records a frame carrying dataLen bytes of data.
+func (a *activity) record(dataLen int) {
+	atomic.AddInt64(&a.bytes, int64(dataLen))
+	atomic.AddInt64(&a.frames, 1)
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// addBytes adds dataLen bytes of data to the most recently recorded frame.
+func (a *activity) addBytes(dataLen int) {
+	atomic.AddInt64(&a.bytes, int64(dataLen))
+}
+
+func (a *activity) getBytes() int64 {
+	return atomic.LoadInt64(&a.bytes)
+}
+
+func (a *activity) getFrames() int64 {
+	return atomic.LoadInt64(&a.frames)
+}
+
+// lastActivity returns the later of the last activity in a and b.
+func lastActivity(a *activity, b *activity) time.Time {
+	last := atomic.LoadInt64(&a.last)
+	if bLast := atomic.LoadInt64(&b.last); bLast > last {
+		last = bLast
+	}
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// frameTypeNames names each frame type for SessionStats, indexed by frame type
+var frameTypeNames = [numFrameTypes]string{
+	frameTypeData:         "data",
+	frameTypeACK:          "ack",
+	frameTypeRST:          "rst",
+	frameTypeFIN:          "fin",
+	frameTypePING:         "ping",
+	frameTypePONG:         "pong",
+	frameTypeGOAWAY:       "goaway",
+	frameTypeWindowUpdate: "window_update",
+	frameTypeSYN:          "syn",
+	frameTypeSYNACK:       "syn_ack",
+	frameTypeREFUSE:       "refuse",
+}
+
+// frameTypeName returns the name of the given frame type. Unknown frame types
+// are treated as data, just like recvLoop does.
+func frameTypeName(ft byte) string {
+	if ft >= numFrameTypes {
+		ft = frameTypeData
+	}
+	return frameTypeNames[ft]
+}
+
+// frameCounter counts the frames going through a session in one direction by
+// frame type.
+type frameCounter struct {
+	frames [numFrameTypes]int64 // accessed atomically
+	bytes  [numFrameTypes]int64 // accessed atomically
+}
+
+// count records a frame of the given type that took up wireLen bytes. Unknown
+// frame types are treated as data, just like recvLoop does.
+func (fc *frameCounter) count(ft byte, wireLen int) {
+	if ft >= numFrameTypes {
+		ft = frameTypeData
+	}
+	atomic.AddInt64(&fc.frames[ft], 1)
+	atomic.AddInt64(&fc.bytes[ft], int64(wireLen))
+}
+
+// addBytes adds wireLen bytes to the frames of the given type.
+func (fc *frameCounter) addBytes(ft byte, wireLen int) {
+	if ft >= numFrameTypes {
+		ft = frameTypeData
+	}
+	atomic.AddInt64(&fc.bytes[ft], int64(wireLen))
+}
+
+func (fc *frameCounter) snapshot() map[string]FrameStats {
+	result := make(map[string]FrameStats, numFrameTypes)
+	for ft, name := range frameTypeNames {
+		result[name] = FrameStats{
+			Frames: atomic.LoadInt64(&fc.frames[ft]),
+			Bytes:  atomic.LoadInt64(&fc.bytes[ft]),
+		}
+	}
+	return result
+}
+
+// latencies sums up latency samples.
+type latencies struct {
+	count int64 // accessed atomically
+	total int64 // nanos, accessed atomically
+}
+
+func (l *latencies) record(latency time.Duration) {
+	atomic.AddInt64(&l.count, 1)
+	atomic.AddInt64(&l.total, int64(latency))
+}
+
+func (l *latencies) getCount() int64 {
+	return atomic.LoadInt64(&l.count)
+}
+
+func (l *latencies) getTotal() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.total))
+}
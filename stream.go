@@ -1,6 +1,8 @@
 package connmux
 
 import (
+	"context"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -10,16 +12,21 @@ import (
 // managed by a session.
 type stream struct {
 	net.Conn
+	ctx           context.Context
+	metadata      Metadata
 	id            []byte
 	session       *session
 	pool          BufferPool
 	rb            *receiveBuffer
 	sb            *sendBuffer
+	opened        chan error
 	readDeadline  time.Time
 	writeDeadline time.Time
 	closed        bool
+	notifiedOpen  bool
 	finalReadErr  error
 	finalWriteErr error
+	peerCloseErr  error
 	mx            sync.RWMutex
 }
 
@@ -31,7 +38,11 @@ func (c *stream) Read(b []byte) (int, error) {
 	if finalReadErr != nil {
 		return 0, finalReadErr
 	}
-	return c.rb.read(b, readDeadline)
+	n, err := c.rb.read(b, readDeadline)
+	if err == io.EOF {
+		err = c.eofErr()
+	}
+	return n, err
 }
 
 func (c *stream) Write(b []byte) (int, error) {
@@ -39,47 +50,145 @@ func (c *stream) Write(b []byte) (int, error) {
 		return c.writeChunks(b)
 	}
 
+	// copy buffer since we hang on to it past the call to Write but callers
+	// expect that they can reuse the buffer after Write returns
+	frame := c.pool.getForFrame()[:len(b)]
+	copy(frame, b)
+	return c.sendFrame(frame)
+}
+
+// WriteFrame implements the method from Stream
+func (c *stream) WriteFrame(b []byte) (int, error) {
+	if len(b) > MaxDataLen || cap(b) < maxFrameLen {
+		// Not a buffer from the pool, fall back to copying it. Since the pool
+		// didn't hand it out, it mustn't end up in the pool either.
+		return c.Write(b)
+	}
+	return c.sendFrame(b)
+}
+
+// sendFrame queues a pooled buffer holding no more than MaxDataLen bytes of
+// data for sending. The stream takes ownership of the buffer, which is returned
+// to the pool once it has been sent (or right away if it won't be sent).
+func (c *stream) sendFrame(b []byte) (int, error) {
 	c.mx.RLock()
 	closed := c.closed
 	writeDeadline := c.writeDeadline
 	finalWriteErr := c.finalWriteErr
 	c.mx.RUnlock()
 	if finalWriteErr != nil {
+		c.pool.Put(b[:maxFrameLen])
 		return 0, finalWriteErr
 	}
 	if closed {
 		// Make it look like the write worked even though we're not going to send it
 		// anywhere (TODO, might be better way to handle this?)
+		c.pool.Put(b[:maxFrameLen])
 		return len(b), nil
 	}
 
-	// copy buffer since we hang on to it past the call to Write but callers
-	// expect that they can reuse the buffer after Write returns
-	_b := b
-	b = c.pool.getForFrame()[:len(b)]
-	copy(b, _b)
-
 	if writeDeadline.IsZero() {
 		// Don't bother implementing a timeout
+		c.sb.onWrite(b)
 		c.sb.in <- b
 		return len(b), nil
 	}
 
 	now := time.Now()
 	if writeDeadline.Before(now) {
+		c.pool.Put(b[:maxFrameLen])
 		return 0, ErrTimeout
 	}
 	timer := time.NewTimer(writeDeadline.Sub(now))
+	c.sb.onWrite(b)
 	select {
 	case c.sb.in <- b:
 		timer.Stop()
 		return len(b), nil
 	case <-timer.C:
 		timer.Stop()
+		c.sb.onSent(b)
+		c.pool.Put(b[:maxFrameLen])
 		return 0, ErrTimeout
 	}
 }
 
+// ReadFrame implements the method from Stream
+func (c *stream) ReadFrame() ([]byte, error) {
+	c.mx.RLock()
+	readDeadline := c.readDeadline
+	finalReadErr := c.finalReadErr
+	c.mx.RUnlock()
+	if finalReadErr != nil {
+		return nil, finalReadErr
+	}
+	b, err := c.rb.readFrame(readDeadline)
+	if err == io.EOF {
+		err = c.eofErr()
+	}
+	return b, err
+}
+
+// ReadFrom implements the interface io.ReaderFrom. It reads from r directly
+// into pooled frames, so that copying to the stream with io.Copy doesn't need
+// an intermediate buffer.
+func (c *stream) ReadFrom(r io.Reader) (int64, error) {
+	var totalN int64
+	for {
+		b := c.pool.getForFrame()[:MaxDataLen]
+		n, readErr := r.Read(b)
+		if n > 0 {
+			written, writeErr := c.sendFrame(b[:n])
+			totalN += int64(written)
+			if writeErr != nil {
+				return totalN, writeErr
+			}
+		} else {
+			c.pool.Put(b[:maxFrameLen])
+		}
+		if readErr == io.EOF {
+			return totalN, nil
+		}
+		if readErr != nil {
+			return totalN, readErr
+		}
+	}
+}
+
+// WriteTo implements the interface io.WriterTo. It writes received frames
+// directly to w until the other end closes the stream, so that copying from the
+// stream with io.Copy doesn't need an intermediate buffer.
+func (c *stream) WriteTo(w io.Writer) (int64, error) {
+	c.mx.RLock()
+	finalReadErr := c.finalReadErr
+	c.mx.RUnlock()
+	if finalReadErr == io.EOF {
+		return 0, nil
+	}
+	if finalReadErr != nil {
+		return 0, finalReadErr
+	}
+	n, err := c.rb.writeTo(w, c.getReadDeadline)
+	if err == nil {
+		if closedErr := c.eofErr(); closedErr != io.EOF {
+			err = closedErr
+		}
+	}
+	return n, err
+}
+
+// eofErr returns the error to report when reads hit the end of the stream,
+// which is io.EOF unless the other end closed the stream with a CloseCode
+// other than CloseNormal.
+func (c *stream) eofErr() error {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	if c.peerCloseErr != nil {
+		return c.peerCloseErr
+	}
+	return io.EOF
+}
+
 // writeChunks breaks the buffer down into units smaller than MaxDataLen in size
 func (c *stream) writeChunks(b []byte) (int, error) {
 	totalN := 0
@@ -100,26 +209,153 @@ func (c *stream) writeChunks(b []byte) (int, error) {
 }
 
 func (c *stream) Close() error {
-	return c.close(true, ErrConnectionClosed, ErrConnectionClosed)
+	err := c.close(true, ErrConnectionClosed, ErrConnectionClosed, nil)
+	// We won't be reading anything else, so stop holding on to buffered data
+	c.rb.drain()
+	return err
+}
+
+// CloseWithError implements the method from Stream
+func (c *stream) CloseWithError(code CloseCode, reason string) error {
+	if code == CloseNormal {
+		return c.Close()
+	}
+	reason = truncateCloseReason(reason)
+	err := c.doClose(closeRequest{sendRST: true, code: code, reason: reason},
+		ErrConnectionClosed, ErrConnectionClosed, &StreamClosedError{Code: code, Reason: reason})
+	c.rb.drain()
+	return err
+}
+
+// CloseWrite implements the method from Stream
+func (c *stream) CloseWrite() error {
+	if !c.session.supportsControlFrames() {
+		return ErrUnsupported
+	}
+	c.mx.Lock()
+	if c.closed || c.finalWriteErr != nil {
+		c.mx.Unlock()
+		return nil
+	}
+	c.finalWriteErr = ErrBrokenPipe
+	c.mx.Unlock()
+	c.sb.closeWrite()
+	return nil
+}
+
+// CloseRead implements the method from Stream
+func (c *stream) CloseRead() error {
+	c.mx.Lock()
+	if c.closed || c.finalReadErr != nil {
+		c.mx.Unlock()
+		return nil
+	}
+	c.finalReadErr = io.EOF
+	c.mx.Unlock()
+	c.rb.closeRead()
+	return nil
+}
+
+// close closes the stream, making subsequent reads and writes fail with readErr
+// and writeErr. reason is reported to the hooks as the reason for closing, nil
+// meaning that either end closed the stream normally.
+func (c *stream) close(sendRST bool, readErr error, writeErr error, reason error) error {
+	return c.doClose(closeRequest{sendRST: sendRST}, readErr, writeErr, reason)
 }
 
-func (c *stream) close(sendRST bool, readErr error, writeErr error) error {
+// closeByPeer closes the stream because the other end sent an RST, with closeErr
+// being the error that it gave for closing, if any. Writes fail with closeErr
+// right away, but reads first get whatever data was already received and only
+// then return closeErr.
+func (c *stream) closeByPeer(closeErr error) {
+	c.mx.Lock()
+	c.peerCloseErr = closeErr
+	c.mx.Unlock()
+	c.close(false, nil, closeErr, closeErr)
+}
+
+// doClose is like close, but tells the sendBuffer exactly how to close.
+func (c *stream) doClose(req closeRequest, readErr error, writeErr error, reason error) error {
 	didClose := false
+	notifyClose := false
 	c.mx.Lock()
 	if !c.closed {
 		c.closed = true
 		c.finalReadErr = readErr
 		c.finalWriteErr = writeErr
 		didClose = true
+		notifyClose = c.notifiedOpen
 	}
 	c.mx.Unlock()
+	if notifyClose {
+		c.session.hooks.OnStreamClose(c, reason)
+	}
 	if didClose {
 		c.rb.close()
-		c.sb.close(sendRST)
+		c.sb.requestClose(req)
+		go func() {
+			// Wait for pending frames to be sent before forgetting about the stream
+			<-c.sb.done
+			c.session.removeStream(binaryEncoding.Uint32(c.id))
+		}()
 	}
 	return nil
 }
 
+// onOpened notifies whoever is opening the stream that the other end accepted
+// (err is nil) or refused it.
+func (c *stream) onOpened(err error) {
+	if c.opened == nil {
+		return
+	}
+	select {
+	case c.opened <- err:
+		// notified
+	default:
+		// already notified
+	}
+}
+
+// Stats implements the method from Stream
+func (c *stream) Stats() StreamStats {
+	return StreamStats{
+		BytesSent:      c.sb.sent.getBytes(),
+		BytesReceived:  c.rb.received.getBytes(),
+		FramesSent:     c.sb.sent.getFrames(),
+		FramesReceived: c.rb.received.getFrames(),
+		QueuedFrames:   c.sb.queuedFrames(),
+		BufferedBytes:  c.sb.bufferedBytes(),
+		SendCredit:     c.sb.credit.value(),
+		PendingACKs:    c.rb.pendingACKs(),
+		LastActivity:   lastActivity(&c.sb.sent, &c.rb.received),
+	}
+}
+
+// ID implements the method from Stream
+func (c *stream) ID() uint32 {
+	return binaryEncoding.Uint32(c.id)
+}
+
+// Metadata implements the method from Stream
+func (c *stream) Metadata() Metadata {
+	return c.metadata
+}
+
+// Context implements the method from Stream
+func (c *stream) Context() context.Context {
+	return c.ctx
+}
+
+// SetPriority implements the method from Stream
+func (c *stream) SetPriority(priority int) {
+	c.sb.queue.setPriority(priority)
+}
+
+// Priority implements the method from Stream
+func (c *stream) Priority() int {
+	return c.sb.queue.getPriority()
+}
+
 func (c *stream) LocalAddr() net.Addr {
 	return c.Conn.LocalAddr()
 }
@@ -136,6 +372,12 @@ func (c *stream) SetDeadline(t time.Time) error {
 	return nil
 }
 
+func (c *stream) getReadDeadline() time.Time {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.readDeadline
+}
+
 func (c *stream) SetReadDeadline(t time.Time) error {
 	c.mx.Lock()
 	c.readDeadline = t